@@ -0,0 +1,271 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Code generated by go run gen_bluenoise.go -output bluenoise.go; DO NOT EDIT.
+
+package gogif
+
+// blueNoise is the 64×64 map BlueNoise returns.
+var blueNoise = &ThresholdMap{
+	Width:  64,
+	Height: 64,
+	Values: []int{
+		1769, 421, 2193, 716, 3552, 176, 3029, 1908, 2805, 113, 2424, 3680, 1829, 2713, 495, 1118,
+		770, 3784, 66, 2633, 3035, 920, 2072, 243, 1262, 2285, 328, 3381, 1364, 2965, 2296, 1783,
+		1235, 2772, 1906, 2999, 570, 1431, 277, 1972, 1138, 536, 2089, 2952, 1389, 553, 2785, 1630,
+		2121, 615, 3770, 2835, 1396, 89, 1779, 3230, 838, 2993, 3427, 1735, 3741, 3164, 1400, 2566,
+		3290, 3702, 1592, 3055, 1117, 2355, 1404, 417, 4086, 1731, 3257, 592, 2996, 1349, 3526, 3135,
+		2292, 3412, 1524, 2161, 3814, 454, 3228, 4032, 2648, 600, 2874, 1684, 2528, 3624, 608, 3090,
+		3676, 975, 307, 1602, 2514, 3798, 875, 2372, 3614, 1605, 3262, 234, 2336, 3506, 1951, 272,
+		4051, 3195, 1588, 1995, 679, 3533, 2654, 4087, 1594, 160, 2140, 559, 997, 2753, 329, 667,
+		2689, 879, 2427, 356, 1929, 3766, 3270, 2143, 759, 1294, 2238, 1079, 3947, 33, 2474, 1743,
+		285, 2904, 586, 3532, 1178, 1773, 2426, 1540, 1007, 3119, 3861, 883, 26, 2007, 1565, 344,
+		2545, 2133, 4060, 3435, 1080, 3144, 1703, 2924, 77, 2577, 970, 4019, 2670, 1131, 3149, 812,
+		2592, 1012, 412, 2459, 3084, 2145, 1048, 534, 1988, 3561, 2789, 3845, 2267, 1636, 4044, 2011,
+		168, 1429, 3955, 3223, 2812, 576, 941, 2539, 3548, 2944, 365, 2643, 1664, 2102, 919, 3883,
+		1239, 1918, 899, 2462, 182, 2914, 673, 3446, 122, 1887, 1288, 2223, 3462, 1153, 3941, 852,
+		3336, 1441, 691, 2331, 215, 2080, 512, 3975, 1315, 3394, 1858, 686, 1537, 87, 3848, 2308,
+		1385, 2918, 3482, 1221, 3862, 302, 1514, 3147, 2553, 1222, 727, 1464, 18, 3018, 1187, 3437,
+		2945, 2114, 1152, 50, 1752, 1346, 3943, 1607, 138, 1932, 3828, 3339, 776, 3638, 2954, 532,
+		3328, 2664, 4075, 3141, 2040, 3854, 1325, 2127, 3774, 2479, 3235, 460, 2628, 3027, 2174, 2801,
+		1824, 98, 3179, 2856, 1348, 3524, 2683, 792, 2139, 376, 3014, 3606, 2196, 2899, 1770, 378,
+		3657, 1884, 12, 1688, 809, 2790, 3642, 2273, 216, 3929, 1870, 3313, 2437, 3621, 782, 1736,
+		3865, 552, 3407, 2639, 3601, 2385, 405, 2782, 3167, 886, 1438, 2375, 179, 1319, 2556, 1603,
+		2209, 99, 1362, 1651, 432, 940, 3288, 2779, 352, 1593, 764, 4081, 1485, 239, 641, 3492,
+		1076, 3765, 1979, 888, 3928, 1841, 1130, 3217, 3661, 1453, 2438, 1049, 518, 3490, 1263, 3289,
+		663, 2214, 3966, 2615, 3379, 1942, 1290, 659, 3255, 989, 2927, 457, 1113, 2051, 270, 2515,
+		973, 2316, 1581, 761, 2010, 1038, 3326, 2069, 1202, 3701, 524, 2838, 1885, 3214, 343, 3825,
+		1074, 3523, 748, 2733, 3615, 2357, 1726, 601, 1161, 3571, 2896, 1851, 1005, 3740, 1677, 2415,
+		389, 2647, 1503, 497, 2552, 5, 2364, 426, 1755, 2766, 119, 3776, 1960, 2535, 876, 2706,
+		1561, 2961, 980, 558, 2346, 162, 4025, 1804, 2630, 1538, 2212, 3487, 2665, 3747, 1415, 3276,
+		1935, 3095, 284, 4049, 3025, 211, 3853, 714, 2662, 2286, 1595, 3932, 1090, 3556, 2074, 635,
+		3060, 2399, 1902, 3271, 1142, 8, 4018, 2526, 3107, 2105, 92, 2396, 3343, 2073, 3140, 1363,
+		4030, 2164, 3600, 2964, 3398, 1576, 3834, 3059, 915, 3998, 1246, 1679, 3180, 181, 4043, 2090,
+		345, 3736, 1337, 3229, 1550, 3028, 832, 3469, 406, 3804, 103, 870, 1616, 618, 2873, 442,
+		1323, 3646, 2771, 1236, 1719, 2502, 1393, 1776, 3, 3519, 361, 3087, 688, 2428, 1466, 2738,
+		1708, 249, 3949, 564, 2154, 3016, 1369, 1896, 845, 3912, 1327, 546, 2737, 823, 126, 2893,
+		700, 1179, 224, 995, 2030, 689, 1264, 1944, 2522, 619, 3354, 2356, 824, 1513, 3075, 1140,
+		3375, 2403, 131, 2038, 3835, 1098, 2173, 2846, 1184, 2473, 1978, 2985, 4070, 2360, 1788, 3810,
+		2561, 596, 939, 2253, 3418, 520, 3672, 2867, 3226, 918, 1982, 2574, 1759, 95, 4027, 889,
+		3618, 1124, 2828, 1483, 2601, 3753, 517, 3261, 231, 2604, 3405, 1720, 3662, 1287, 3819, 1913,
+		3365, 2765, 1781, 3246, 2409, 3659, 2774, 321, 3546, 2182, 268, 2858, 3840, 548, 2447, 1836,
+		744, 1629, 3537, 2727, 471, 2499, 255, 1478, 3168, 575, 3597, 1312, 253, 1123, 3385, 42,
+		2159, 1683, 3540, 102, 2707, 846, 1977, 1109, 2240, 4066, 1365, 3421, 1008, 2884, 3249, 452,
+		2303, 3342, 1846, 860, 283, 2035, 1020, 3654, 1548, 2022, 1027, 3044, 278, 2224, 2562, 508,
+		1546, 2263, 3721, 547, 1380, 135, 3176, 1042, 1511, 3011, 1784, 991, 2059, 3557, 2783, 221,
+		3881, 2905, 1191, 797, 1792, 3373, 3687, 1867, 3982, 943, 1691, 3237, 2207, 2680, 760, 3064,
+		1073, 3996, 3142, 1939, 1509, 3956, 3123, 240, 1613, 513, 2823, 223, 3805, 2106, 1193, 1900,
+		1397, 62, 3822, 2934, 3449, 1608, 2769, 2340, 2963, 573, 3758, 2441, 867, 1606, 3473, 1067,
+		3959, 63, 887, 2974, 3914, 1725, 2149, 4088, 682, 3763, 1310, 3403, 35, 1408, 1056, 3263,
+		2225, 414, 2008, 4079, 3058, 1313, 625, 2686, 25, 2379, 2800, 350, 3545, 1890, 3891, 1534,
+		201, 2320, 511, 1292, 2988, 422, 2304, 3486, 2611, 3625, 836, 2345, 1495, 591, 3645, 2692,
+		3099, 2463, 633, 2165, 1146, 3909, 373, 753, 1270, 3299, 46, 1844, 3987, 2973, 336, 3209,
+		2669, 1420, 2461, 2048, 1093, 2696, 459, 2534, 1905, 2712, 430, 2325, 2655, 4026, 1970, 807,
+		1481, 3442, 2582, 73, 1579, 2359, 1010, 3132, 2104, 1281, 3849, 662, 1493, 986, 411, 2845,
+		3348, 2644, 866, 3779, 2477, 1075, 1758, 752, 1317, 2020, 3052, 1751, 3215, 2493, 198, 775,
+		3773, 1046, 1701, 3281, 158, 2504, 3175, 1803, 4033, 2234, 1472, 2810, 609, 1333, 2160, 1762,
+		728, 3081, 3630, 304, 3470, 766, 3317, 1268, 172, 3466, 910, 3160, 1615, 466, 3513, 2421,
+		3069, 642, 1115, 3639, 2940, 289, 3887, 1632, 3434, 825, 2972, 2026, 2605, 3117, 3595, 1993,
+		1189, 1645, 3495, 2039, 133, 3319, 3888, 2798, 68, 3815, 1137, 354, 4009, 1289, 3347, 2231,
+		1521, 385, 4077, 2723, 1414, 1961, 983, 3501, 251, 2617, 1069, 3413, 2391, 3648, 992, 3864,
+		191, 1952, 1204, 1698, 2886, 1457, 3730, 2319, 3047, 1569, 3950, 1941, 754, 2983, 1215, 150,
+		1697, 3927, 2272, 1882, 895, 3315, 2046, 489, 2563, 266, 1730, 3712, 142, 1321, 2402, 565,
+		3759, 2968, 337, 1518, 2700, 617, 2115, 1558, 3177, 2436, 685, 2751, 2047, 905, 2818, 1842,
+		3503, 2967, 2000, 789, 3619, 467, 2925, 1507, 2071, 781, 3812, 409, 1956, 294, 2839, 2305,
+		3371, 2583, 3762, 582, 2237, 36, 1828, 988, 531, 2112, 1169, 108, 3732, 2132, 2621, 3644,
+		2821, 326, 1354, 2752, 448, 2467, 1174, 3564, 1465, 4055, 1072, 3323, 2281, 816, 4013, 1789,
+		955, 2266, 705, 4085, 3108, 1256, 3567, 959, 465, 1777, 3295, 3683, 1591, 22, 3829, 528,
+		1132, 136, 2567, 1283, 3155, 2217, 3873, 588, 2742, 3205, 1619, 2936, 1282, 3309, 1649, 808,
+		1437, 420, 1009, 3193, 3979, 2571, 3106, 3846, 2685, 3607, 2903, 2465, 3303, 990, 1528, 621,
+		1922, 3222, 723, 3424, 4016, 1745, 2831, 713, 3078, 2222, 2729, 399, 1557, 3184, 2748, 69,
+		1958, 3285, 2525, 996, 1853, 2390, 192, 2913, 4029, 2183, 1383, 314, 2609, 3116, 2113, 1410,
+		3187, 2256, 3699, 598, 1785, 30, 2460, 1255, 3744, 154, 2352, 957, 4089, 2498, 6, 2997,
+		3936, 2191, 2792, 1875, 788, 1230, 384, 1590, 848, 227, 1440, 671, 1727, 355, 3866, 2311,
+		1128, 3727, 2442, 1596, 1000, 82, 3677, 1969, 171, 882, 1857, 3634, 637, 2094, 1166, 3456,
+		2870, 261, 1360, 3445, 433, 3843, 1618, 2559, 1171, 3432, 856, 2365, 1096, 3553, 747, 2457,
+		3954, 928, 1529, 2863, 4003, 1114, 3278, 1739, 818, 1965, 3585, 491, 1815, 708, 3623, 2002,
+		1125, 3464, 128, 1497, 3576, 2124, 3345, 2451, 1928, 3420, 2323, 3938, 3079, 2719, 3428, 2,
+		3013, 1488, 222, 2084, 3082, 2334, 1398, 3268, 2512, 3790, 1311, 3003, 2417, 3916, 370, 1494,
+		654, 3948, 1729, 2718, 2098, 828, 3083, 561, 1917, 85, 2986, 3910, 1860, 443, 1656, 2890,
+		195, 1930, 3376, 298, 2065, 2708, 456, 3520, 2871, 2530, 1446, 3338, 2200, 3100, 1368, 2722,
+		554, 1707, 3062, 2510, 297, 2878, 684, 4054, 1078, 2978, 504, 1016, 1915, 1295, 771, 2018,
+		2584, 913, 3946, 2775, 628, 3817, 413, 1032, 1692, 540, 3307, 210, 1024, 1757, 2613, 3613,
+		2361, 1147, 3051, 52, 3716, 1195, 3361, 2258, 3792, 2740, 649, 1448, 3221, 2724, 3760, 1224,
+		3510, 704, 2542, 1253, 3580, 894, 2283, 1357, 311, 3974, 1119, 100, 2673, 994, 388, 3793,
+		2414, 885, 4031, 1103, 3746, 1413, 1767, 71, 2717, 1505, 3720, 2216, 200, 2527, 4072, 1650,
+		3194, 529, 3384, 1180, 1728, 3333, 2028, 2916, 4000, 2659, 2168, 1564, 2857, 3363, 798, 2032,
+		290, 3761, 813, 2246, 1535, 2864, 204, 1406, 1003, 1704, 3617, 2147, 161, 924, 2052, 371,
+		2295, 3043, 1746, 3181, 648, 1617, 3734, 3136, 1852, 678, 3001, 1639, 3897, 3448, 1539, 1891,
+		3341, 333, 2274, 1994, 475, 3282, 2342, 3493, 2097, 353, 3231, 1662, 3555, 3143, 449, 1108,
+		3612, 2257, 1907, 287, 2634, 829, 2420, 1341, 375, 933, 3507, 645, 3755, 1, 1302, 3206,
+		2847, 1820, 2564, 3541, 631, 1878, 4002, 2580, 3440, 273, 2458, 1209, 4080, 2568, 3306, 1585,
+		3970, 1083, 60, 3869, 2387, 2923, 137, 1028, 2195, 3491, 2456, 1991, 746, 2254, 169, 2932,
+		1218, 2763, 1480, 3129, 757, 2698, 1198, 851, 3844, 1269, 729, 2855, 911, 1450, 2354, 2826,
+		127, 1347, 2895, 3898, 1482, 3531, 38, 3663, 3200, 1992, 1394, 2544, 1811, 2294, 4061, 1604,
+		969, 3357, 1353, 335, 3151, 2394, 931, 533, 2062, 2830, 831, 3076, 1775, 604, 1335, 2872,
+		774, 2705, 2190, 1449, 434, 1898, 4023, 2721, 1491, 229, 3831, 478, 1305, 3199, 2489, 3976,
+		785, 3514, 47, 3692, 1813, 3920, 175, 2943, 1696, 2570, 2260, 3993, 56, 1986, 3824, 712,
+		1812, 3767, 869, 2321, 563, 3031, 1085, 1686, 2313, 218, 3939, 3037, 435, 1077, 2672, 500,
+		2194, 156, 3832, 2093, 1149, 3649, 1658, 2982, 3894, 1530, 3324, 331, 2219, 3468, 115, 3707,
+		2005, 323, 3438, 3695, 1105, 2490, 577, 3410, 794, 3183, 1106, 2860, 3598, 1723, 982, 445,
+		2111, 1672, 2332, 1039, 2581, 1359, 2023, 3256, 308, 3666, 492, 1780, 2674, 3443, 1213, 3034,
+		2162, 3245, 235, 3439, 1791, 2128, 4094, 2684, 613, 2877, 1206, 784, 3578, 1968, 3133, 3669,
+		2521, 1560, 2928, 731, 2667, 392, 3349, 101, 1245, 643, 1897, 3807, 1061, 2971, 1665, 2383,
+		1203, 3089, 1638, 758, 2987, 3296, 1299, 1774, 2290, 2610, 1599, 2122, 27, 2623, 3480, 1423,
+		3156, 3787, 636, 2998, 368, 3502, 698, 2397, 1050, 3391, 1388, 3138, 1037, 330, 2412, 469,
+		1520, 1044, 2488, 1237, 2791, 351, 811, 1428, 3785, 1872, 3392, 1646, 2382, 132, 1418, 703,
+		3968, 1062, 3274, 1927, 4046, 1329, 2309, 1989, 2695, 3511, 2326, 1399, 2650, 701, 3995, 914,
+		3389, 566, 2573, 1963, 254, 2118, 3811, 79, 3539, 423, 3713, 872, 4068, 607, 1967, 2824,
+		267, 2453, 1284, 3372, 1687, 2235, 4039, 1526, 2794, 1888, 814, 2198, 3710, 1652, 3196, 3931,
+		2625, 3549, 597, 3917, 1544, 3318, 2369, 3068, 145, 966, 2608, 325, 3771, 2795, 3409, 1847,
+		2841, 493, 2376, 32, 1693, 3092, 791, 3837, 1035, 404, 2933, 0, 3560, 1964, 236, 2808,
+		1817, 3764, 1343, 4057, 2834, 1489, 906, 3005, 1188, 1903, 2938, 1318, 3063, 2301, 1164, 3678,
+		796, 1919, 3960, 109, 2842, 962, 496, 3104, 70, 3877, 2590, 196, 2900, 632, 1950, 902,
+		155, 1778, 3127, 2024, 67, 3696, 1167, 1948, 3574, 2227, 3190, 1367, 2067, 805, 1219, 341,
+		3351, 1467, 3719, 923, 3422, 550, 2576, 1499, 3039, 1787, 3962, 925, 2425, 1331, 3286, 2210,
+		431, 2416, 39, 976, 3497, 543, 2595, 2178, 3997, 696, 2470, 281, 1674, 3362, 153, 1620,
+		3056, 1058, 2614, 1430, 2029, 3700, 2496, 1247, 2120, 646, 3452, 1205, 4028, 1419, 2300, 3629,
+		2797, 1376, 2374, 948, 2953, 724, 2558, 401, 1580, 697, 3977, 488, 3021, 3885, 2575, 2148,
+		693, 2001, 2989, 1258, 2704, 2208, 3690, 134, 3364, 605, 2166, 1577, 3115, 589, 3655, 1030,
+		1500, 3225, 2730, 1798, 2298, 3212, 1738, 324, 3254, 1506, 3499, 2004, 3782, 859, 2497, 3921,
+		2137, 402, 3616, 710, 3330, 265, 1801, 3799, 3267, 1583, 2388, 1837, 424, 2725, 3352, 1155,
+		557, 4050, 360, 3603, 1685, 2180, 4007, 3219, 2773, 1225, 2455, 1924, 1011, 1566, 83, 3670,
+		1102, 2516, 214, 3906, 1805, 387, 1144, 2036, 2472, 1308, 2809, 3718, 359, 2588, 1709, 2869,
+		3875, 630, 1160, 3725, 395, 835, 3594, 1088, 2754, 104, 1006, 2606, 458, 2887, 1384, 587,
+		3383, 2851, 1742, 2261, 2947, 1127, 2732, 793, 377, 2848, 965, 3126, 3590, 844, 28, 1831,
+		3010, 2060, 3312, 1233, 2656, 440, 1002, 1816, 90, 3668, 2912, 228, 3569, 2349, 3124, 1747,
+		4083, 3234, 1556, 629, 3498, 2951, 1626, 4035, 777, 3522, 212, 1045, 1910, 4074, 817, 252,
+		1901, 3429, 2167, 2969, 1586, 2676, 2058, 3827, 1653, 2341, 3907, 3163, 1208, 2187, 3242, 1879,
+		1122, 173, 1330, 4082, 526, 1628, 3593, 2012, 1377, 3902, 140, 2099, 1496, 2555, 2189, 3816,
+		1519, 711, 2484, 151, 3093, 3778, 1460, 3461, 2107, 878, 1681, 3233, 1307, 719, 2767, 450,
+		2242, 842, 2822, 2068, 2445, 855, 3218, 292, 2636, 1802, 3146, 2377, 3325, 1297, 2277, 3085,
+		2551, 1386, 116, 909, 4010, 250, 1340, 653, 2957, 418, 1874, 739, 1721, 4034, 51, 2594,
+		3803, 2351, 3471, 944, 3074, 2541, 7, 3162, 2271, 3459, 2598, 672, 3971, 1057, 3072, 322,
+		2757, 1017, 3874, 1584, 1966, 780, 2876, 2478, 568, 3880, 2259, 509, 3992, 2016, 3404, 1374,
+		3535, 55, 3751, 1181, 349, 1432, 3656, 2245, 1097, 3860, 1492, 549, 2734, 107, 3450, 1022,
+		503, 3919, 3186, 1838, 2410, 3387, 3094, 2199, 3460, 1248, 3622, 3022, 309, 3425, 952, 1574,
+		715, 2799, 1943, 259, 2142, 1361, 3934, 1043, 480, 1734, 1238, 3182, 1893, 463, 3691, 1336,
+		3504, 2337, 3202, 535, 3583, 2243, 208, 1324, 3346, 1111, 2745, 1531, 2531, 951, 248, 1839,
+		1116, 2550, 1668, 3036, 3967, 2677, 1909, 584, 2888, 61, 2202, 922, 3923, 1454, 2041, 3737,
+		1700, 2248, 1145, 2829, 599, 1516, 1040, 24, 2622, 880, 2081, 2513, 1411, 2764, 2297, 3591,
+		3114, 487, 1504, 3236, 3777, 750, 1823, 2434, 2958, 830, 3706, 185, 2395, 2883, 1682, 666,
+		2021, 86, 1848, 1352, 2681, 1051, 4065, 3032, 1945, 364, 3589, 11, 3006, 3694, 2317, 2937,
+		730, 3203, 505, 2226, 961, 144, 3165, 1231, 3393, 1749, 3698, 2946, 1850, 709, 2995, 291,
+		2762, 726, 3530, 274, 3806, 2284, 3633, 1827, 4052, 1551, 213, 3886, 675, 1954, 381, 1196,
+		1818, 3994, 1023, 2626, 419, 2852, 3536, 245, 3298, 2079, 2747, 1567, 3436, 1170, 2230, 3239,
+		2693, 934, 3961, 3012, 315, 3416, 1765, 725, 2600, 1444, 3189, 1849, 1241, 602, 1563, 3951,
+		2092, 1447, 3703, 1866, 3525, 2392, 1622, 3796, 802, 2407, 1304, 382, 2546, 3528, 2299, 1214,
+		3327, 1490, 2572, 1971, 892, 3024, 407, 2796, 623, 3191, 2350, 2930, 1120, 3173, 3826, 2880,
+		190, 2507, 2091, 3584, 1240, 2279, 1571, 1095, 4006, 1373, 639, 3858, 362, 834, 4091, 220,
+		3586, 1293, 2430, 664, 2103, 1523, 2398, 118, 3808, 2239, 795, 3937, 2138, 3297, 2511, 369,
+		3451, 2786, 194, 1285, 718, 2949, 408, 2109, 2761, 247, 3563, 3098, 1025, 1633, 556, 3859,
+		1881, 130, 4042, 1259, 3344, 1710, 1182, 2123, 3426, 1303, 1748, 516, 3673, 1600, 820, 2197,
+		1403, 3337, 779, 72, 1864, 3355, 510, 2637, 1920, 57, 2536, 2146, 3009, 1914, 2560, 1543,
+		2955, 472, 1741, 3264, 3791, 853, 3130, 3509, 1163, 2894, 410, 2666, 1001, 233, 3637, 1175,
+		786, 2348, 3978, 2599, 3353, 1470, 4076, 1071, 3265, 1573, 674, 1911, 4036, 16, 3207, 2500,
+		877, 3086, 2185, 567, 2651, 94, 3893, 2524, 938, 146, 3554, 2675, 2155, 37, 2547, 3463,
+		473, 2980, 1627, 3930, 2882, 921, 3674, 3045, 734, 3749, 3166, 904, 1436, 3378, 499, 1019,
+		1981, 3838, 2645, 1065, 260, 2833, 1350, 484, 2053, 1689, 3708, 1421, 3122, 1654, 2825, 1895,
+		3266, 1614, 438, 956, 2135, 29, 2503, 572, 1975, 3867, 2629, 2244, 1382, 2879, 2045, 1154,
+		3626, 397, 1570, 2939, 3735, 1998, 695, 1536, 2836, 3963, 1953, 854, 3332, 1274, 4063, 1871,
+		1110, 3652, 2229, 1300, 2476, 256, 2087, 1445, 2353, 1183, 1702, 3602, 183, 2776, 3752, 2251,
+		3484, 23, 1462, 2288, 3455, 1923, 2586, 3988, 947, 3272, 159, 2469, 736, 4067, 2247, 114,
+		1094, 2931, 2019, 3684, 3118, 1794, 3592, 2891, 1356, 141, 926, 3401, 357, 3742, 687, 1675,
+		2784, 2362, 3465, 819, 1387, 2371, 3547, 3048, 486, 2255, 1455, 396, 2984, 1711, 327, 2840,
+		732, 2603, 288, 650, 3260, 1667, 4071, 390, 3423, 2793, 317, 2471, 1112, 1814, 741, 1339,
+		3150, 873, 2908, 4045, 594, 1625, 78, 2307, 2994, 657, 2163, 3587, 1863, 470, 1338, 3789,
+		363, 3518, 1320, 614, 2671, 1197, 765, 2293, 3715, 3065, 1744, 2804, 1199, 2384, 3308, 164,
+		3999, 1064, 1865, 180, 3152, 1015, 339, 1856, 1141, 3185, 3795, 2557, 1070, 3739, 2367, 3210,
+		1475, 3821, 1999, 3007, 3745, 1158, 2715, 971, 1899, 626, 3856, 2025, 3198, 4015, 2386, 338,
+		2578, 1854, 398, 2088, 1271, 3073, 3693, 1148, 1796, 3882, 1280, 2832, 1018, 3458, 3017, 2591,
+		2086, 2492, 1740, 3841, 205, 1589, 3356, 286, 1104, 2101, 494, 3983, 790, 1821, 2661, 1463,
+		2150, 603, 2862, 3836, 2543, 1705, 4092, 2690, 3478, 787, 167, 1826, 3417, 522, 908, 2063,
+		91, 3370, 1718, 901, 2312, 19, 2131, 3538, 3153, 1372, 3004, 841, 1469, 125, 2919, 1661,
+		3908, 3335, 1052, 3596, 2632, 861, 3366, 544, 2744, 275, 1609, 3287, 84, 2324, 1501, 833,
+		4024, 65, 896, 3171, 2380, 2861, 4021, 1859, 2688, 3300, 1525, 2328, 3441, 276, 3682, 958,
+		3169, 3577, 1232, 2056, 483, 3275, 1344, 4, 2406, 2066, 1265, 2897, 2186, 1439, 2787, 3981,
+		1207, 2480, 482, 1390, 3575, 2885, 745, 1575, 170, 2172, 2565, 479, 3632, 2082, 3283, 1165,
+		655, 2221, 1549, 2962, 199, 2278, 1459, 2037, 3775, 2408, 810, 2597, 3958, 1980, 527, 3248,
+		1211, 2875, 3467, 1973, 1121, 379, 2152, 932, 585, 3754, 43, 3097, 1379, 2085, 2920, 519,
+		2485, 53, 1562, 3408, 945, 2252, 720, 3643, 1522, 3113, 4001, 651, 3635, 244, 3304, 1795,
+		751, 3023, 3868, 2658, 400, 1753, 3952, 2418, 3667, 954, 3969, 1786, 2735, 981, 446, 3688,
+		2814, 96, 3802, 721, 1807, 3895, 391, 2942, 1014, 3382, 1937, 403, 1223, 2915, 3675, 1714,
+		706, 2280, 1541, 579, 3884, 1424, 3406, 3002, 1722, 1279, 2579, 960, 578, 3940, 1694, 1277,
+		3786, 1808, 2755, 319, 3890, 2607, 3008, 1976, 984, 474, 2491, 1663, 1036, 2653, 2333, 436,
+		3650, 2134, 978, 1931, 3399, 1176, 3050, 501, 1316, 3247, 295, 1250, 3430, 2329, 1572, 2517,
+		1832, 1332, 2431, 3252, 998, 2540, 3197, 1695, 15, 1371, 3665, 3105, 1634, 903, 257, 2642,
+		3145, 3780, 348, 2624, 2950, 755, 2432, 207, 3957, 2204, 3516, 1904, 2816, 2419, 237, 3103,
+		2232, 644, 3049, 2119, 1172, 1733, 219, 3935, 2749, 3508, 202, 3279, 2017, 3913, 1276, 1610,
+		2837, 129, 1477, 3174, 193, 2117, 863, 2697, 1949, 2854, 2275, 707, 3057, 31, 4073, 803,
+		3517, 3015, 498, 2064, 3568, 1286, 581, 4090, 2343, 2714, 647, 2171, 3872, 2435, 3544, 2055,
+		148, 1830, 1252, 3566, 2049, 1670, 3627, 1126, 2710, 762, 386, 3216, 1190, 3620, 778, 3453,
+		1013, 4005, 1391, 3559, 545, 3188, 1407, 640, 1800, 2206, 1334, 2907, 773, 44, 3041, 930,
+		3483, 2429, 4058, 690, 2523, 3801, 3454, 1517, 74, 3521, 1598, 3847, 1936, 1433, 2901, 2096,
+		232, 1101, 3989, 1612, 147, 2803, 2184, 881, 3444, 1806, 1173, 186, 2811, 571, 1474, 1091,
+		3985, 2464, 3273, 937, 21, 3154, 523, 1921, 3269, 1435, 3857, 1657, 143, 2176, 1456, 2620,
+		1983, 111, 2405, 891, 2703, 3800, 2315, 3340, 1151, 3729, 542, 2400, 3396, 1886, 3679, 2100,
+		627, 1822, 1136, 2956, 1673, 1249, 462, 2363, 4040, 1084, 437, 2554, 946, 3565, 555, 1291,
+		3301, 2687, 2276, 840, 3120, 1894, 3640, 1512, 342, 2935, 3794, 3322, 972, 1880, 3374, 2921,
+		862, 560, 1601, 2179, 4084, 1309, 2327, 3724, 106, 2494, 2070, 3019, 890, 4048, 2902, 346,
+		1640, 2960, 3369, 1835, 178, 2006, 935, 2596, 93, 2819, 1637, 4069, 1026, 1487, 468, 2508,
+		3310, 299, 3581, 2233, 264, 3291, 2780, 1833, 683, 2959, 2203, 3329, 197, 2709, 2228, 3863,
+		1712, 366, 3479, 1351, 3879, 453, 1099, 3172, 2440, 799, 2078, 1443, 2373, 3922, 383, 2201,
+		2652, 3689, 3042, 428, 2549, 2881, 897, 1647, 2975, 1031, 612, 3658, 2368, 1810, 583, 3213,
+		3772, 1228, 521, 3709, 1484, 3077, 444, 3973, 2083, 806, 3066, 282, 2262, 2768, 3870, 1177,
+		2992, 1461, 2646, 936, 3905, 2054, 839, 3722, 3158, 1395, 1763, 3733, 1168, 1660, 3148, 864,
+		2537, 1985, 692, 2948, 1699, 2291, 2756, 112, 3984, 1716, 514, 3128, 54, 2731, 1659, 1326,
+		123, 1840, 1135, 3527, 1476, 606, 3878, 300, 3433, 1375, 2815, 316, 1314, 3474, 1100, 2268,
+		738, 2108, 2538, 1063, 2758, 3570, 1242, 1715, 3472, 1416, 3628, 1861, 699, 3240, 203, 1768,
+		783, 3986, 1946, 539, 3096, 1553, 124, 1227, 2486, 225, 622, 2820, 2015, 490, 3605, 152,
+		1201, 3088, 3717, 34, 2593, 658, 3686, 1987, 1272, 3419, 2641, 3768, 1217, 737, 3562, 3220,
+		3871, 2302, 2843, 238, 2027, 3331, 1772, 2612, 2156, 3756, 1940, 3253, 2518, 10, 2806, 3942,
+		1412, 3316, 305, 4056, 1912, 656, 2411, 3020, 312, 2640, 1089, 2448, 3769, 1275, 2129, 3588,
+		2366, 9, 2917, 1267, 2378, 3604, 2716, 3400, 1873, 3991, 3227, 916, 3901, 2381, 1409, 2759,
+		3964, 1542, 949, 2076, 1186, 3395, 1498, 827, 2859, 209, 968, 2181, 1790, 2966, 2057, 1033,
+		624, 1427, 843, 3945, 2452, 999, 3125, 1220, 768, 441, 1655, 927, 3842, 1559, 1959, 416,
+		2638, 1754, 2981, 871, 2306, 45, 3377, 963, 2158, 610, 3259, 58, 1554, 3030, 502, 2728,
+		1086, 3481, 1621, 3743, 310, 1082, 2095, 569, 977, 2270, 1568, 2602, 40, 3386, 800, 2136,
+		574, 2433, 3321, 2849, 4038, 269, 3102, 2249, 3911, 1623, 2454, 3311, 439, 4064, 262, 2495,
+		1876, 3496, 3061, 1635, 525, 3664, 49, 2339, 3000, 3990, 2739, 2220, 676, 3054, 3402, 1004,
+		3572, 121, 1296, 3494, 1631, 3809, 1370, 2844, 3671, 1680, 4014, 2777, 1947, 912, 3953, 1471,
+		3251, 680, 2033, 2520, 769, 3277, 1648, 3820, 3053, 280, 3609, 1254, 1892, 3046, 1641, 2926,
+		3551, 217, 1793, 481, 1425, 2505, 1862, 451, 3244, 681, 3714, 1434, 837, 2627, 1260, 3139,
+		415, 2616, 105, 2169, 2746, 1322, 1934, 3489, 1555, 258, 1185, 3582, 306, 1273, 2423, 580,
+		2213, 3855, 2009, 2529, 429, 2702, 743, 1869, 166, 1139, 2218, 767, 3542, 2393, 157, 1843,
+		2282, 242, 3134, 1378, 4059, 2868, 75, 2501, 1422, 2788, 772, 2215, 551, 3711, 313, 1216,
+		1974, 898, 3750, 2330, 763, 3636, 1054, 2736, 1261, 2110, 271, 2941, 1990, 3380, 1611, 3788,
+		2130, 1156, 3830, 907, 3204, 4053, 702, 2679, 964, 3284, 2481, 1717, 2911, 4078, 1771, 2865,
+		1486, 3109, 1059, 660, 3170, 2077, 3305, 3924, 2487, 3137, 1405, 380, 3067, 1234, 2635, 3647,
+		985, 3903, 2750, 455, 1819, 2153, 1212, 3477, 393, 1996, 3192, 3918, 2678, 1041, 2466, 4062,
+		3241, 2682, 1159, 3071, 1597, 2889, 64, 3851, 1669, 3505, 2533, 1143, 3899, 13, 2347, 733,
+		2977, 1532, 3358, 1868, 303, 1587, 2241, 177, 3738, 1889, 590, 3178, 874, 2125, 184, 3731,
+		815, 347, 2663, 4022, 1266, 246, 1515, 1034, 485, 3485, 2649, 3757, 1724, 665, 3360, 476,
+		2991, 1676, 1229, 3558, 942, 3159, 668, 2264, 3972, 1055, 1671, 110, 1479, 3476, 1845, 677,
+		1527, 80, 2116, 3933, 358, 3515, 2031, 2370, 537, 893, 3080, 1732, 595, 2802, 1047, 3641,
+		163, 2446, 538, 2850, 1200, 2585, 3573, 3033, 1345, 2192, 3839, 59, 1473, 2694, 1107, 3208,
+		2468, 1916, 3397, 1690, 2287, 3748, 2807, 2358, 1764, 822, 1984, 206, 2338, 4095, 1962, 1442,
+		2175, 742, 2322, 2587, 174, 3781, 2701, 1761, 464, 2909, 3415, 2389, 821, 3091, 241, 2250,
+		2922, 3608, 611, 1834, 2569, 801, 1328, 3302, 2827, 4047, 189, 2265, 3610, 1545, 3294, 1926,
+		4037, 857, 3534, 2177, 3904, 593, 929, 1766, 394, 2853, 1133, 2413, 3320, 3915, 477, 1642,
+		3543, 1192, 88, 2910, 847, 562, 3529, 14, 2979, 3980, 1194, 2866, 1508, 953, 2906, 117,
+		3280, 3726, 318, 3334, 2014, 1129, 1502, 3653, 2450, 1358, 638, 3818, 1938, 2726, 1342, 3852,
+		1021, 2519, 1381, 3390, 1092, 3110, 1760, 301, 1029, 1458, 1955, 3224, 865, 2506, 340, 1244,
+		2711, 1797, 1401, 263, 2970, 1997, 3314, 2443, 4011, 804, 3579, 1782, 620, 1933, 2314, 2898,
+		652, 2170, 3681, 1426, 3201, 2043, 1666, 1243, 3293, 2157, 634, 3705, 3243, 461, 2449, 3876,
+		1134, 2720, 1799, 1451, 4012, 530, 3038, 20, 917, 3250, 2144, 187, 1066, 3685, 506, 3350,
+		2003, 332, 2990, 2236, 139, 4004, 2657, 3704, 2318, 3388, 2668, 1226, 427, 3926, 2151, 3112,
+		616, 3723, 2548, 987, 3475, 1468, 17, 1257, 3131, 1644, 230, 2770, 1278, 3660, 120, 1402,
+		3850, 950, 2404, 425, 2589, 1060, 3900, 2631, 372, 1547, 2475, 97, 1809, 3550, 1392, 670,
+		2050, 447, 3111, 868, 2817, 2335, 3512, 2061, 2781, 4093, 1713, 2619, 3161, 1510, 2439, 850,
+		1706, 3965, 722, 3631, 1533, 515, 2013, 740, 1643, 48, 669, 3697, 1825, 2778, 967, 1582,
+		2289, 188, 3232, 1883, 507, 2743, 3823, 2205, 541, 2618, 2075, 3447, 3070, 979, 2532, 3292,
+		334, 3101, 1750, 4008, 3368, 165, 2310, 717, 3457, 974, 3157, 2741, 1157, 2126, 2691, 3211,
+		1578, 2422, 3896, 1301, 149, 1756, 1053, 661, 1552, 296, 1210, 3431, 367, 2188, 2976, 41,
+		3238, 2699, 1150, 1877, 2509, 3026, 1162, 3488, 2813, 3944, 2034, 3040, 1355, 3500, 81, 3367,
+		1087, 2929, 1306, 4017, 2483, 1678, 858, 3411, 1068, 3783, 1417, 849, 320, 2141, 4041, 1624,
+		2042, 2760, 1251, 694, 1925, 1452, 3599, 2892, 1737, 3797, 1957, 756, 4020, 279, 900, 3813,
+		76, 3414, 735, 2211, 3651, 3258, 2660, 3889, 3121, 2482, 3728, 826, 1855, 3925, 993, 3611,
+		1298, 2344, 226, 3359, 884, 3833, 2269, 374, 1366, 2401, 1081, 293, 2444, 749, 2044, 3892,
+	},
+}
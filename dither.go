@@ -0,0 +1,300 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+)
+
+//go:generate go run gen_bluenoise.go -output bluenoise.go
+
+// Dither describes how a quantizer dithers the pixels it maps to a
+// palette, to hide the banding of smooth gradients.
+type Dither struct {
+	// Kernel, if non-nil, diffuses the difference between each pixel and
+	// its palette color over the pixels not yet mapped.
+	Kernel *Kernel
+	// Serpentine scans every other row right to left when diffusing, which
+	// avoids the diagonal artifacts of always scanning the same way.
+	Serpentine bool
+	// Ordered, if non-nil and Kernel is nil, offsets each pixel by the
+	// threshold map tiled over dst before mapping it. A map whose size
+	// does not match its values is ignored. The offsets depend
+	// only on the position in dst, so regions that do not change between
+	// the frames of an animation are dithered identically.
+	Ordered *ThresholdMap
+	// Strength scales the dithering, from 0 to 1. Zero means 1.
+	Strength float64
+}
+
+// A Kernel is an error diffusion kernel.
+type Kernel struct {
+	// Weights give the shares of a pixel's error that go to its
+	// neighbors, each Weight/Divisor of it.
+	Weights []KernelWeight
+	Divisor int
+}
+
+// A KernelWeight is the share of a pixel's error that goes to the pixel
+// DX to the right of it, or left when scanning right to left, and DY
+// below it.
+type KernelWeight struct {
+	DX, DY, Weight int
+}
+
+// The classic error diffusion kernels.
+var (
+	FloydSteinberg = &Kernel{
+		Weights: []KernelWeight{
+			{1, 0, 7},
+			{-1, 1, 3}, {0, 1, 5}, {1, 1, 1},
+		},
+		Divisor: 16,
+	}
+	// Atkinson diffuses only three quarters of the error, which keeps
+	// more contrast.
+	Atkinson = &Kernel{
+		Weights: []KernelWeight{
+			{1, 0, 1}, {2, 0, 1},
+			{-1, 1, 1}, {0, 1, 1}, {1, 1, 1},
+			{0, 2, 1},
+		},
+		Divisor: 8,
+	}
+	Sierra = &Kernel{
+		Weights: []KernelWeight{
+			{1, 0, 5}, {2, 0, 3},
+			{-2, 1, 2}, {-1, 1, 4}, {0, 1, 5}, {1, 1, 4}, {2, 1, 2},
+			{-1, 2, 2}, {0, 2, 3}, {1, 2, 2},
+		},
+		Divisor: 32,
+	}
+	JarvisJudiceNinke = &Kernel{
+		Weights: []KernelWeight{
+			{1, 0, 7}, {2, 0, 5},
+			{-2, 1, 3}, {-1, 1, 5}, {0, 1, 7}, {1, 1, 5}, {2, 1, 3},
+			{-2, 2, 1}, {-1, 2, 3}, {0, 2, 5}, {1, 2, 3}, {2, 2, 1},
+		},
+		Divisor: 48,
+	}
+)
+
+// strength returns d.Strength as a fraction of 256.
+func (d *Dither) strength() int32 {
+	if d.Strength <= 0 || d.Strength >= 1 {
+		return 256
+	}
+	return int32(d.Strength * 256)
+}
+
+// diffuse maps the pixels read from sp to the pixels of dst in r, with
+// the error diffusion d describes. Invisible and fully transparent pixels
+// are mapped as they are, neither taking nor passing on any error.
+func (m *pixelMapper) diffuse(dst *image.Paletted, r image.Rectangle, read rowReader, sp image.Point, d *Dither) {
+	k := d.Kernel
+	maxDX, maxDY := 0, 0
+	for _, w := range k.Weights {
+		maxDX = max(maxDX, max(w.DX, -w.DX))
+		maxDY = max(maxDY, w.DY)
+	}
+	// errs holds the error to add to the pixels of the next maxDY+1 rows,
+	// padded on either side, 3 channels each, scaled by k.Divisor. It is
+	// used as a ring.
+	dx := r.Dx()
+	stride := 3 * (dx + 2*maxDX)
+	errs := make([][]int32, maxDY+1)
+	for i := range errs {
+		errs[i] = make([]int32, stride)
+	}
+	strength := d.strength()
+	div := int32(k.Divisor)
+	row := make([]color.RGBA64, dx)
+	for y := 0; y < r.Dy(); y++ {
+		read(row, sp.X, sp.Y+y)
+		pix := dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y+y):]
+		cur := errs[y%len(errs)]
+		x0, x1, step := 0, dx, 1
+		if d.Serpentine && y%2 == 1 {
+			x0, x1, step = dx-1, -1, -1
+		}
+		for x := x0; x != x1; x += step {
+			c, ok := visibleColor(row[x], m.threshold)
+			if !ok {
+				pix[x] = m.transparent
+				continue
+			}
+			if c.A == 0 {
+				pix[x] = uint8(m.x.index(c))
+				continue
+			}
+			e := cur[3*(x+maxDX):]
+			t := color.RGBA64{
+				clampChannel(int32(c.R)+e[0]/div, c.A),
+				clampChannel(int32(c.G)+e[1]/div, c.A),
+				clampChannel(int32(c.B)+e[2]/div, c.A),
+				c.A,
+			}
+			i := m.x.index(t)
+			pix[x] = uint8(i)
+			if len(m.palette) == 0 {
+				continue
+			}
+			p := m.palette[i]
+			er := (int32(t.R) - int32(p.R)) * strength >> 8
+			eg := (int32(t.G) - int32(p.G)) * strength >> 8
+			eb := (int32(t.B) - int32(p.B)) * strength >> 8
+			for _, w := range k.Weights {
+				nx := x + step*w.DX
+				if nx < 0 || nx >= dx || y+w.DY >= r.Dy() {
+					continue
+				}
+				ne := errs[(y+w.DY)%len(errs)][3*(nx+maxDX):]
+				wt := int32(w.Weight)
+				ne[0] += er * wt
+				ne[1] += eg * wt
+				ne[2] += eb * wt
+			}
+		}
+		// This row's errors have all been used; clear it for reuse.
+		for i := range cur {
+			cur[i] = 0
+		}
+	}
+}
+
+// clampChannel clamps v to a valid premultiplied channel value for alpha
+// a.
+func clampChannel(v int32, a uint16) uint16 {
+	switch {
+	case v < 0:
+		return 0
+	case v > int32(a):
+		return a
+	}
+	return uint16(v)
+}
+
+// A ThresholdMap is a pattern for ordered dithering.
+type ThresholdMap struct {
+	Width, Height int
+	// Values holds the rank of each cell, from 0 to Width*Height-1, row
+	// by row. A pixel is offset by its cell's rank less half the number
+	// of cells, scaled to the spacing of the palette colors.
+	Values []int
+}
+
+// valid reports whether t has a value for each of its cells.
+func (t *ThresholdMap) valid() bool {
+	return t.Width > 0 && t.Height > 0 && t.Width*t.Height == len(t.Values)
+}
+
+// Bayer returns the n×n Bayer matrix, with n rounded up to a power of
+// two.
+func Bayer(n int) *ThresholdMap {
+	n = 1 << uint(bits.Len(uint(max(n, 1)-1)))
+	t := &ThresholdMap{Width: n, Height: n, Values: make([]int, n*n)}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			// Interleave the bits of x^y and y in reverse order.
+			v, xy := 0, x^y
+			for bit := 1; bit < n; bit <<= 1 {
+				v <<= 2
+				if xy&bit != 0 {
+					v |= 2
+				}
+				if y&bit != 0 {
+					v |= 1
+				}
+			}
+			t.Values[y*n+x] = v
+		}
+	}
+	return t
+}
+
+// BlueNoise returns a 64×64 blue noise threshold map. Its pattern has no
+// visible structure, unlike a Bayer matrix's. It was made by the
+// void-and-cluster method, by gen_bluenoise.go. Each call returns a new
+// map, which the caller may change.
+func BlueNoise() *ThresholdMap {
+	t := *blueNoise
+	t.Values = append([]int(nil), blueNoise.Values...)
+	return &t
+}
+
+// spread returns the mean distance from each palette color to the nearest
+// other one, which is how far apart the colors an ordered dither mixes
+// are.
+func (m *pixelMapper) spread() float64 {
+	if len(m.palette) < 2 {
+		return 0
+	}
+	sum := 0.0
+	for i, c := range m.palette {
+		best := math.Inf(1)
+		for j, o := range m.palette {
+			if i == j {
+				continue
+			}
+			dr := float64(c.R) - float64(o.R)
+			dg := float64(c.G) - float64(o.G)
+			db := float64(c.B) - float64(o.B)
+			da := float64(c.A) - float64(o.A)
+			if d := dr*dr + dg*dg + db*db + da*da; d > 0 && d < best {
+				best = d
+			}
+		}
+		if !math.IsInf(best, 1) {
+			sum += math.Sqrt(best)
+		}
+	}
+	return sum / float64(len(m.palette))
+}
+
+// order maps the pixels read from sp to the pixels of dst in r, with the
+// ordered dither d describes. Invisible and fully transparent pixels are
+// mapped as they are.
+func (m *pixelMapper) order(dst *image.Paletted, r image.Rectangle, read rowReader, sp image.Point, d *Dither) {
+	t := d.Ordered
+	cells := len(t.Values)
+	// offsets holds the offset for each cell.
+	offsets := make([]int32, cells)
+	scale := m.spread() * float64(d.strength()) / 256 / float64(cells)
+	for i, v := range t.Values {
+		offsets[i] = int32((float64(v) + 0.5 - float64(cells)/2) * scale)
+	}
+	row := make([]color.RGBA64, r.Dx())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		read(row, sp.X, sp.Y+y-r.Min.Y)
+		pix := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		cell := offsets[mod(y, t.Height)*t.Width : (mod(y, t.Height)+1)*t.Width]
+		for i, c := range row {
+			c, ok := visibleColor(c, m.threshold)
+			if !ok {
+				pix[i] = m.transparent
+				continue
+			}
+			if c.A != 0 {
+				o := cell[mod(r.Min.X+i, t.Width)]
+				c.R = clampChannel(int32(c.R)+o, c.A)
+				c.G = clampChannel(int32(c.G)+o, c.A)
+				c.B = clampChannel(int32(c.B)+o, c.A)
+			}
+			pix[i] = uint8(m.x.index(c))
+		}
+	}
+}
+
+// mod returns x modulo n, which is never negative.
+func mod(x, n int) int {
+	x %= n
+	if x < 0 {
+		x += n
+	}
+	return x
+}
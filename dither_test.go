@@ -0,0 +1,179 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// gradient returns a horizontal gray ramp.
+func gradient() *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, 256, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 256; x++ {
+			m.SetGray(x, y, color.Gray{uint8(x)})
+		}
+	}
+	return m
+}
+
+// blockError returns the sum over the 16x16 blocks of m of the difference
+// between the mean gray level of the block in m and in src.
+func blockError(m *image.Paletted, src *image.Gray) int {
+	sum := 0
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y += 16 {
+		for x := b.Min.X; x < b.Max.X; x += 16 {
+			got, want := 0, 0
+			for j := y; j < y+16; j++ {
+				for i := x; i < x+16; i++ {
+					r, _, _, _ := m.At(i, j).RGBA()
+					got += int(r >> 8)
+					want += int(src.GrayAt(i, j).Y)
+				}
+			}
+			sum += abs(got-want) / 256
+		}
+	}
+	return sum
+}
+
+func TestDiffusion(t *testing.T) {
+	src := gradient()
+	plain := image.NewPaletted(src.Bounds(), nil)
+	(&MedianCutQuantizer{NumColor: 4}).Quantize(plain, src.Bounds(), src, image.ZP)
+	base := blockError(plain, src)
+	kernels := map[string]*Kernel{
+		"FloydSteinberg":    FloydSteinberg,
+		"Atkinson":          Atkinson,
+		"Sierra":            Sierra,
+		"JarvisJudiceNinke": JarvisJudiceNinke,
+	}
+	for name, k := range kernels {
+		for _, serpentine := range []bool{false, true} {
+			for _, strength := range []float64{0, 0.75} {
+				dst := image.NewPaletted(src.Bounds(), nil)
+				q := &MedianCutQuantizer{
+					NumColor: 4,
+					Dither:   Dither{Kernel: k, Serpentine: serpentine, Strength: strength},
+				}
+				q.Quantize(dst, src.Bounds(), src, image.ZP)
+				if got := blockError(dst, src); got >= base {
+					t.Errorf("%s serpentine=%v strength=%v: block error %d, want less than %d undithered",
+						name, serpentine, strength, got, base)
+				}
+			}
+		}
+	}
+}
+
+func TestDiffusionAlpha(t *testing.T) {
+	src := sticker(16)
+	dst := image.NewPaletted(src.Bounds(), nil)
+	q := &MedianCutQuantizer{
+		NumColor:       16,
+		AlphaThreshold: 0x40 * 0x101,
+		Dither:         Dither{Kernel: FloydSteinberg},
+	}
+	q.Quantize(dst, src.Bounds(), src, image.ZP)
+	transparent := uint8(len(dst.Palette) - 1)
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			invisible := src.NRGBAAt(x, y).A == 0
+			if got := dst.ColorIndexAt(x, y) == transparent; got != invisible {
+				t.Fatalf("(%d, %d): transparent %v, want %v", x, y, got, invisible)
+			}
+		}
+	}
+}
+
+func TestThresholdMaps(t *testing.T) {
+	want := []int{
+		0, 8, 2, 10,
+		12, 4, 14, 6,
+		3, 11, 1, 9,
+		15, 7, 13, 5,
+	}
+	if got := Bayer(4).Values; !reflect.DeepEqual(got, want) {
+		t.Errorf("Bayer(4): got %v, want %v", got, want)
+	}
+	// Other sizes are rounded up.
+	for n, want := range map[int]int{-1: 1, 0: 1, 1: 1, 3: 4, 5: 8, 16: 16} {
+		if m := Bayer(n); m.Width != want || m.Height != want || len(m.Values) != want*want {
+			t.Errorf("Bayer(%d): got a %dx%d map with %d values, want %dx%d", n, m.Width, m.Height, len(m.Values), want, want)
+		}
+	}
+	for _, m := range []*ThresholdMap{Bayer(2), Bayer(8), Bayer(16), BlueNoise()} {
+		seen := make([]bool, len(m.Values))
+		for _, v := range m.Values {
+			if v < 0 || v >= len(seen) || seen[v] {
+				t.Fatalf("%dx%d map: rank %d out of range or repeated", m.Width, m.Height, v)
+			}
+			seen[v] = true
+		}
+	}
+}
+
+func TestBlueNoiseCopy(t *testing.T) {
+	// Changing one map does not change the next.
+	m := BlueNoise()
+	want := append([]int(nil), m.Values...)
+	m.Width = 1
+	m.Values[0], m.Values[1] = m.Values[1], m.Values[0]
+	if m := BlueNoise(); m.Width != 64 || !reflect.DeepEqual(m.Values, want) {
+		t.Error("BlueNoise returned a map changed by an earlier caller")
+	}
+}
+
+func TestOrderedDitherInvalidMap(t *testing.T) {
+	// A map that does not match its size is ignored rather than indexed
+	// out of range.
+	src := gradient()
+	want := image.NewPaletted(src.Bounds(), nil)
+	(&MedianCutQuantizer{NumColor: 4}).Quantize(want, src.Bounds(), src, image.ZP)
+	for _, m := range []*ThresholdMap{
+		{Width: 4, Height: 4, Values: []int{0, 1, 2}},
+		{Width: 0, Height: 4},
+		{Width: -2, Height: -2, Values: []int{0, 1, 2, 3}},
+	} {
+		dst := image.NewPaletted(src.Bounds(), nil)
+		(&MedianCutQuantizer{NumColor: 4, Dither: Dither{Ordered: m}}).Quantize(dst, src.Bounds(), src, image.ZP)
+		if !reflect.DeepEqual(dst.Pix, want.Pix) {
+			t.Errorf("%dx%d map with %d values: pixels differ from undithered", m.Width, m.Height, len(m.Values))
+		}
+	}
+}
+
+func TestOrderedDither(t *testing.T) {
+	src := gradient()
+	plain := image.NewPaletted(src.Bounds(), nil)
+	(&MedianCutQuantizer{NumColor: 4}).Quantize(plain, src.Bounds(), src, image.ZP)
+	base := blockError(plain, src)
+	for _, m := range []*ThresholdMap{Bayer(2), Bayer(4), Bayer(8), BlueNoise()} {
+		q := &MedianCutQuantizer{NumColor: 4, Dither: Dither{Ordered: m}}
+		dst := image.NewPaletted(src.Bounds(), nil)
+		q.Quantize(dst, src.Bounds(), src, image.ZP)
+		if got := blockError(dst, src); got >= base {
+			t.Errorf("%dx%d map: block error %d, want less than %d undithered", m.Width, m.Height, got, base)
+		}
+
+		// The pattern follows dst, so quantizing part of the frame gives
+		// the same pixels there.
+		part := image.Rect(37, 5, 200, 50)
+		sub := image.NewPaletted(src.Bounds(), dst.Palette)
+		remap(sub, part, src, part.Min, 0, &q.Dither)
+		for y := part.Min.Y; y < part.Max.Y; y++ {
+			for x := part.Min.X; x < part.Max.X; x++ {
+				if sub.ColorIndexAt(x, y) != dst.ColorIndexAt(x, y) {
+					t.Fatalf("%dx%d map: (%d, %d) differs when remapped alone", m.Width, m.Height, x, y)
+				}
+			}
+		}
+	}
+}
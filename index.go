@@ -0,0 +1,209 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// IndexedFrame describes a frame found by NewIndex.
+type IndexedFrame struct {
+	// Offset is the byte offset of the frame's image descriptor.
+	Offset int64
+	Bounds image.Rectangle
+	// Palette is the frame's local color table, or the global one if it
+	// has none, as stored in the file.
+	Palette    color.Palette
+	Interlaced bool
+	// GraphicControl is the graphic control extension that applies to
+	// the frame, or nil if there is none.
+	GraphicControl *GraphicControl
+}
+
+// Index gives random access to the frames of a GIF file.
+type Index struct {
+	r io.ReaderAt
+
+	// Width and Height are the dimensions of the logical screen.
+	Width, Height int
+	// Palette is the global color table, or nil.
+	Palette color.Palette
+	// LoopCount is the loop count, as in gif.GIF.
+	LoopCount int
+	Frames    []IndexedFrame
+}
+
+// NewIndex scans the GIF file read from r once, without decompressing the
+// image data, and records where each frame is.
+func NewIndex(r io.ReaderAt) (*Index, error) {
+	tr := NewTokenizer(io.NewSectionReader(r, 0, 1<<63-1))
+	tr.skipData = true
+	x := &Index{r: r, LoopCount: -1}
+	// gc is the graphic control for the next frame. As when decoding, a
+	// plain text extension in between does not consume it.
+	var gc *GraphicControl
+	for {
+		off := tr.Offset()
+		tok, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case *Header:
+			x.Width, x.Height = t.Width, t.Height
+			x.Palette = paletteFromTable(t.ColorTable)
+
+		case *Extension:
+			if isNetscapeExtension(t) && len(t.Blocks) > 1 {
+				if b := t.Blocks[1]; len(b) == 3 && b[0] == 1 {
+					x.LoopCount = int(b[1]) | int(b[2])<<8
+				}
+			}
+
+		case *GraphicControl:
+			gc = t
+
+		case *ImageBlock:
+			p := x.Palette
+			if t.ColorTable != nil {
+				p = paletteFromTable(t.ColorTable)
+			}
+			x.Frames = append(x.Frames, IndexedFrame{
+				Offset:         off,
+				Bounds:         t.Bounds(),
+				Palette:        p,
+				Interlaced:     t.Fields&ifInterlace != 0,
+				GraphicControl: gc,
+			})
+			gc = nil
+		}
+	}
+	if len(x.Frames) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return x, nil
+}
+
+// paletteFromTable converts a color table of RGB triples to a palette.
+func paletteFromTable(ct []byte) color.Palette {
+	if ct == nil {
+		return nil
+	}
+	p := make(color.Palette, len(ct)/3)
+	for i := range p {
+		p[i] = color.RGBA{ct[3*i], ct[3*i+1], ct[3*i+2], 0xFF}
+	}
+	return p
+}
+
+// Frame decodes frame i, exactly as DecodeAll would.
+func (x *Index) Frame(i int) (*image.Paletted, error) {
+	if i < 0 || i >= len(x.Frames) {
+		return nil, errors.New("gif: frame index out of range")
+	}
+	f := &x.Frames[i]
+	d := decoder{
+		width:          x.Width,
+		height:         x.Height,
+		globalColorMap: x.Palette,
+	}
+	if gc := f.GraphicControl; gc != nil {
+		d.flags = gc.Flags
+		d.delayTime = gc.Delay
+		if gc.HasTransparentIndex() {
+			d.transparentIndex = gc.TransparentIndex
+			d.hasTransparentIndex = true
+		}
+	}
+	// Skip the image separator.
+	start := f.Offset + 1
+	d.setReader(io.NewSectionReader(x.r, start, 1<<63-1-start))
+	d.block = "image descriptor"
+	if err := d.readImage(); err != nil {
+		e := d.wrap(err).(*DecodeError)
+		e.Offset += start
+		e.Frame = i
+		return nil, e
+	}
+	return d.image[0], nil
+}
+
+// disposal returns the disposal method of frame i.
+func (x *Index) disposal(i int) byte {
+	if gc := x.Frames[i].GraphicControl; gc != nil {
+		return gc.Disposal()
+	}
+	return 0
+}
+
+// KeyFrame returns the nearest frame at or before frame i from which the
+// canvas shown at frame i can be rebuilt, starting from a clear canvas.
+func (x *Index) KeyFrame(i int) int {
+	screen := image.Rect(0, 0, x.Width, x.Height)
+	for j := i; j > 0; j-- {
+		f := &x.Frames[j]
+		// A frame covering the whole screen with no transparent pixels
+		// hides everything beneath it. Unless it is disposed by restoring
+		// what it covered before a later frame, that is all the history
+		// that matters.
+		opaque := f.GraphicControl == nil || !f.GraphicControl.HasTransparentIndex()
+		if opaque && screen.In(f.Bounds) && (j == i || x.disposal(j) != gif.DisposalPrevious) {
+			return j
+		}
+		// A previous frame covering the whole screen and disposed to the
+		// background leaves a clear canvas.
+		if x.disposal(j-1) == gif.DisposalBackground && screen.In(x.Frames[j-1].Bounds) {
+			return j
+		}
+	}
+	return 0
+}
+
+// Composite returns the canvas shown at frame i, rebuilt from the nearest
+// key frame. Disposal to the background clears to transparent, as
+// browsers do.
+func (x *Index) Composite(i int) (*image.RGBA, error) {
+	if i < 0 || i >= len(x.Frames) {
+		return nil, errors.New("gif: frame index out of range")
+	}
+	return x.composite(x.KeyFrame(i), i)
+}
+
+// composite returns the canvas shown at frame to, drawing the frames from
+// onwards on a clear canvas.
+func (x *Index) composite(from, to int) (*image.RGBA, error) {
+	canvas := image.NewRGBA(image.Rect(0, 0, x.Width, x.Height))
+	var saved *image.RGBA
+	for i := from; i <= to; i++ {
+		m, err := x.Frame(i)
+		if err != nil {
+			return nil, err
+		}
+		disposal := x.disposal(i)
+		if disposal == gif.DisposalPrevious && i < to {
+			saved = image.NewRGBA(canvas.Bounds())
+			copy(saved.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, m.Bounds(), m, m.Bounds().Min, draw.Over)
+		if i == to {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, m.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	return canvas, nil
+}
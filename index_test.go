@@ -0,0 +1,92 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	for _, filename := range []string{"testdata/shapes.gif", "testdata/blob.gif", "testdata/video-001.interlaced.gif"} {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := NewIndex(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		if len(x.Frames) != len(g.Image) {
+			t.Fatalf("%s: got %d frames, want %d", filename, len(x.Frames), len(g.Image))
+		}
+		// Visit the frames out of order.
+		for i := len(x.Frames) - 1; i >= 0; i -= 3 {
+			m, err := x.Frame(i)
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", filename, i, err)
+			}
+			if !reflect.DeepEqual(m, g.Image[i]) {
+				t.Errorf("%s: frame %d differs from DecodeAll", filename, i)
+			}
+			if x.Frames[i].Bounds != g.Image[i].Bounds() {
+				t.Errorf("%s: frame %d: got bounds %v, want %v", filename, i, x.Frames[i].Bounds, g.Image[i].Bounds())
+			}
+		}
+	}
+}
+
+func TestIndexComposite(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/shapes.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := NewIndex(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, len(x.Frames) / 2, len(x.Frames) - 1} {
+		k := x.KeyFrame(i)
+		if k < 0 || k > i {
+			t.Fatalf("frame %d: key frame %d out of range", i, k)
+		}
+		got, err := x.Composite(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Replaying the whole animation gives the same canvas.
+		want, err := x.composite(0, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("frame %d: composite from key frame %d differs", i, k)
+		}
+	}
+}
+
+func TestIndexPlainTextKeepsGraphicControl(t *testing.T) {
+	// testGIF with a delay, and a plain text extension between its graphic
+	// control extension and its image.
+	text := []byte{0x21, 0x01, 12, 0, 0, 0, 0, 1, 0, 1, 0, 1, 1, 0, 0, 1, 'x', 0x00}
+	b := append(append(append([]byte(nil), testGIF[:27]...), text...), testGIF[27:]...)
+	b[23] = 42
+	x, err := NewIndex(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.Frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(x.Frames))
+	}
+	if gc := x.Frames[0].GraphicControl; gc == nil || gc.Delay != 42 {
+		t.Errorf("got graphic control %v, want delay 42", gc)
+	}
+}
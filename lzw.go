@@ -0,0 +1,567 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// lzwMaxWidth is the maximum code width in bits.
+	lzwMaxWidth = 12
+	// lzwInvalidCode is an invalid code, used to mark that there is no
+	// previous code.
+	lzwInvalidCode = 0xffff
+
+	// The encoder's hash table has lzwTableSize entries, each holding a
+	// 20-bit key, the prefix code and the byte that follow it, and the
+	// 12-bit code it stands for. An empty entry is zero, as no code is.
+	lzwTableSize = 1 << 14
+	lzwTableMask = lzwTableSize - 1
+)
+
+var (
+	errInvalidCode = errors.New("lzw: invalid code")
+	errPixelRange  = errors.New("gif: pixel index outside the color table")
+)
+
+// lzwDecoder is an LZW decoder specialized for GIF image data. Instead of
+// layering a compress/lzw.Reader over a reader of the data sub-blocks, it
+// reads the sub-blocks itself and decodes straight into the frame's pixels,
+// checking each literal against the palette as it goes. As every decoded
+// pixel is a copy of some literal, no separate pass over the pixels is
+// needed.
+//
+// Every code's expansion has already been written to the pixels by the
+// time the code is used, so instead of walking a chain of prefixes the
+// decoder records where each expansion starts and copies it from there.
+// Positions count the pixels in order, row after row; the rows may lie
+// apart in dst, as they do in a frame whose stride exceeds its width.
+type lzwDecoder struct {
+	r reader
+	// The current data sub-block, of which block[bp:bn] is still unread.
+	block  [255]byte
+	bp, bn int
+	// terminated is set once the block terminator has been read.
+	terminated bool
+
+	bits  uint32
+	nBits uint
+
+	litWidth int
+	width    uint
+	// clear and eof are the clear and end-of-information codes, hi is the
+	// next code to be added to the table and overflow is the code at
+	// which hi overflows the current code width. last is the previous
+	// code, whose expansion is the lastLen pixels from lastStart.
+	clear, eof, hi, overflow, last uint16
+	lastStart, lastLen             int
+
+	// Each code c in [eof+1, hi) expands to the length[c] pixels from
+	// position start[c].
+	start  [1 << lzwMaxWidth]int
+	length [1 << lzwMaxWidth]uint16
+
+	// dst receives size pixels, in rows of dx from every stride bytes; the
+	// first n have been decoded. tooMuch is set if an expansion did not
+	// fit.
+	dst        []byte
+	dx, stride int
+	size, n    int
+	tooMuch    bool
+
+	// numColor is the number of valid color indexes. A literal at or
+	// above it is a bad pixel: an error if failBadPixel is set and
+	// recorded in badPixel otherwise.
+	numColor     int
+	failBadPixel bool
+	badPixel     bool
+
+	err error
+}
+
+// reset prepares d to decode the image data read from r into dst, in rows
+// of dx pixels starting every stride bytes, with the given LZW minimum code
+// size and number of colors.
+func (d *lzwDecoder) reset(r reader, dst []byte, dx, stride, litWidth, numColor int, failBadPixel bool) {
+	d.r = r
+	d.bp, d.bn = 0, 0
+	d.terminated = false
+	d.bits, d.nBits = 0, 0
+	d.litWidth = litWidth
+	d.width = 1 + uint(litWidth)
+	d.clear = uint16(1) << uint(litWidth)
+	d.eof, d.hi = d.clear+1, d.clear+1
+	d.overflow = uint16(1) << d.width
+	d.last = lzwInvalidCode
+	d.dst, d.n = dst, 0
+	d.dx, d.stride = dx, stride
+	d.size = 0
+	if dx > 0 && len(dst) > 0 {
+		d.size = (len(dst) + stride - dx) / stride * dx
+	}
+	d.tooMuch = false
+	d.numColor = numColor
+	d.failBadPixel = failBadPixel
+	d.badPixel = false
+	d.err = nil
+}
+
+// nextBlock reads the next data sub-block.
+func (d *lzwDecoder) nextBlock() error {
+	if d.terminated {
+		return io.ErrUnexpectedEOF
+	}
+	n, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if n == 0 {
+		// The image data ended without an end-of-information code.
+		d.terminated = true
+		return io.ErrUnexpectedEOF
+	}
+	if _, err := io.ReadFull(d.r, d.block[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.bp, d.bn = 0, int(n)
+	return nil
+}
+
+// refill loads the bits of the data sub-blocks, as many as fit in d.bits
+// from the current sub-block, and at least d.width of them.
+func (d *lzwDecoder) refill() error {
+	for d.nBits < d.width {
+		if d.bp == d.bn {
+			if err := d.nextBlock(); err != nil {
+				return err
+			}
+		}
+		for d.nBits <= 24 && d.bp < d.bn {
+			d.bits |= uint32(d.block[d.bp]) << d.nBits
+			d.bp++
+			d.nBits += 8
+		}
+	}
+	return nil
+}
+
+// readCode reads the next code, least significant bits first.
+func (d *lzwDecoder) readCode() (uint16, error) {
+	if d.nBits < d.width {
+		if err := d.refill(); err != nil {
+			return 0, err
+		}
+	}
+	code := uint16(d.bits & (1<<d.width - 1))
+	d.bits >>= d.width
+	d.nBits -= d.width
+	return code, nil
+}
+
+// fill decodes pixels until at least end of them have been decoded. It
+// returns io.ErrUnexpectedEOF if the image data ends first.
+func (d *lzwDecoder) fill(end int) error {
+loop:
+	for d.n < end && d.err == nil {
+		if d.nBits < d.width {
+			if err := d.refill(); err != nil {
+				d.err = err
+				break
+			}
+		}
+		code := uint16(d.bits & (1<<d.width - 1))
+		d.bits >>= d.width
+		d.nBits -= d.width
+		n, length := d.n, 1
+		switch {
+		case code < d.clear:
+			// We have a literal code.
+			if int(code) >= d.numColor {
+				d.badPixel = true
+				if d.failBadPixel {
+					d.err = errBadPixel
+					break loop
+				}
+			}
+			d.dst[d.offset(n)] = uint8(code)
+		case code == d.clear:
+			d.width = 1 + uint(d.litWidth)
+			d.hi = d.eof
+			d.overflow = 1 << d.width
+			d.last = lzwInvalidCode
+			continue
+		case code == d.eof:
+			d.err = io.EOF
+			break loop
+		case code == d.hi && d.last != lzwInvalidCode:
+			// code == hi is a special case which expands to the last
+			// expansion followed by its own first byte.
+			length = d.lastLen + 1
+			d.copyExpansion(n, d.lastStart, d.lastLen)
+			if n+d.lastLen < d.size {
+				d.dst[d.offset(n+d.lastLen)] = d.dst[d.offset(d.lastStart)]
+			}
+		case code <= d.hi:
+			length = int(d.length[code])
+			d.copyExpansion(n, d.start[code], length)
+		default:
+			d.err = errInvalidCode
+			break loop
+		}
+		if n+length > d.size {
+			d.tooMuch = true
+			d.n = d.size
+		} else {
+			d.n = n + length
+		}
+		if d.last != lzwInvalidCode {
+			// The hi code expands to the last expansion followed by the
+			// first byte of this one, which is where it was written.
+			d.start[d.hi] = d.lastStart
+			d.length[d.hi] = uint16(d.lastLen + 1)
+		}
+		d.last, d.lastStart, d.lastLen = code, n, length
+		d.hi++
+		if d.hi >= d.overflow {
+			if d.width == lzwMaxWidth {
+				d.last = lzwInvalidCode
+				// Undo the d.hi++ above, so that d.hi < d.overflow and
+				// does not eventually overflow a uint16.
+				d.hi--
+			} else {
+				d.width++
+				d.overflow = 1 << d.width
+			}
+		}
+	}
+	if d.n >= end {
+		return nil
+	}
+	if d.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return d.err
+}
+
+// offset returns the index in dst of the pixel at position i.
+func (d *lzwDecoder) offset(i int) int {
+	if d.stride == d.dx {
+		return i
+	}
+	return i/d.dx*d.stride + i%d.dx
+}
+
+// copyExpansion copies the length pixels from position start to position
+// n, as far as they fit.
+func (d *lzwDecoder) copyExpansion(n, start, length int) {
+	length = min(length, d.size-n)
+	if d.stride == d.dx {
+		copy(d.dst[n:], d.dst[start:start+length])
+		return
+	}
+	// Copy up to the nearer row end, of the source or of the
+	// destination, at a time.
+	for length > 0 {
+		k := min(length, min(d.dx-start%d.dx, d.dx-n%d.dx))
+		i, j := d.offset(n), d.offset(start)
+		copy(d.dst[i:i+k], d.dst[j:j+k])
+		n, start, length = n+k, start+k, length-k
+	}
+}
+
+// rows calls f with the pixels from position i to position j, a row or
+// part of one at a time.
+func (d *lzwDecoder) rows(i, j int, f func(pix []byte)) {
+	for i < j {
+		k := min(j-i, d.dx-i%d.dx)
+		o := d.offset(i)
+		f(d.dst[o : o+k])
+		i += k
+	}
+}
+
+// exhausted checks that the image data has been read to its end: the
+// end-of-information code followed by the block terminator.
+func (d *lzwDecoder) exhausted() error {
+	if d.tooMuch {
+		return errTooMuch
+	}
+	for d.err == nil {
+		code, err := d.readCode()
+		switch {
+		case err != nil:
+			d.err = err
+		case code == d.clear:
+			d.width = 1 + uint(d.litWidth)
+			d.hi = d.eof
+			d.overflow = 1 << d.width
+			d.last = lzwInvalidCode
+		case code == d.eof:
+			d.err = io.EOF
+		default:
+			return errTooMuch
+		}
+	}
+	if d.err != io.EOF {
+		return d.err
+	}
+	if d.bp < d.bn || d.nBits >= 8 {
+		// Data follows the end-of-information code.
+		return errTooMuch
+	}
+	n, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if n != 0 {
+		if _, err := io.ReadFull(d.r, d.block[:n]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		d.bp, d.bn = 0, int(n)
+		return errTooMuch
+	}
+	d.terminated = true
+	return nil
+}
+
+// skip discards the rest of the image data, up to and including the block
+// terminator. It returns a non-nil error if the input ends first.
+func (d *lzwDecoder) skip() error {
+	d.bp = d.bn
+	for !d.terminated {
+		n, err := d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if n == 0 {
+			d.terminated = true
+			break
+		}
+		if _, err := io.ReadFull(d.r, d.block[:n]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// LZWOptions tune the LZW compression of the image data, trading speed for
+// size. The zero value compresses as compress/lzw does.
+type LZWOptions struct {
+	// MaxCodeWidth is the code width, in bits, beyond which the code table
+	// is reset with a clear code. It is at most 12, the default; smaller
+	// tables cost less to fill but compress less.
+	MaxCodeWidth int
+	// KeepFullTable keeps using a full table of 12-bit codes, without
+	// adding to it, instead of resetting it. This suits images whose
+	// colors are alike throughout. It is ignored if MaxCodeWidth is set
+	// below 12.
+	KeepFullTable bool
+	// Uncompressed writes every pixel as a literal code, resetting the
+	// table before the code width can grow. It is the fastest option but
+	// the image data comes out larger than the pixels.
+	Uncompressed bool
+}
+
+// lzwEncoder is an LZW encoder specialized for GIF image data. Instead of
+// layering a compress/lzw.Writer over a writer of data sub-blocks, it packs
+// the codes straight into a sub-block and writes it out when it is full.
+type lzwEncoder struct {
+	w writer
+	// block holds the sub-block being filled: its length byte followed by
+	// bn bytes of data.
+	block [256]byte
+	bn    int
+
+	bits  uint32
+	nBits uint
+
+	litWidth uint
+	width    uint
+	// hi is the code most recently added to the table, overflow the code
+	// at which hi overflows the current code width and maxCode the code at
+	// which the table is reset, or frozen if keepFull is set.
+	hi, overflow, maxCode uint32
+	keepFull, frozen      bool
+	// uncompressed is set to write only literal codes, run of them since
+	// the last clear code.
+	uncompressed bool
+	run          uint32
+	// savedCode is the code for the pixels read but not yet written.
+	savedCode uint32
+	table     [lzwTableSize]uint32
+
+	err error
+}
+
+// reset prepares e to write the image data for pixels of litWidth bits to
+// w, tuned by o.
+func (e *lzwEncoder) reset(w writer, litWidth int, o *LZWOptions) {
+	e.w = w
+	e.bn = 0
+	e.bits, e.nBits = 0, 0
+	e.litWidth = uint(litWidth)
+	maxWidth := uint(lzwMaxWidth)
+	if o.MaxCodeWidth > 0 && o.MaxCodeWidth < lzwMaxWidth {
+		maxWidth = uint(max(o.MaxCodeWidth, litWidth+1))
+	}
+	e.maxCode = 1<<maxWidth - 1
+	e.keepFull = o.KeepFullTable && maxWidth == lzwMaxWidth
+	e.uncompressed = o.Uncompressed
+	e.savedCode = lzwInvalidCode
+	e.err = nil
+	e.width = e.litWidth + 1
+	e.clear()
+}
+
+// clear writes a clear code, at the current code width, and resets the
+// table.
+func (e *lzwEncoder) clear() {
+	clear := uint32(1) << e.litWidth
+	e.writeCode(clear)
+	e.width = e.litWidth + 1
+	e.hi = clear + 1
+	e.overflow = clear << 1
+	e.frozen = false
+	e.run = 0
+	if !e.uncompressed {
+		for i := range e.table {
+			e.table[i] = 0
+		}
+	}
+}
+
+// writeCode packs code into the current sub-block, least significant bits
+// first.
+func (e *lzwEncoder) writeCode(code uint32) {
+	e.bits |= code << e.nBits
+	e.nBits += e.width
+	for e.nBits >= 8 {
+		e.bn++
+		e.block[e.bn] = uint8(e.bits)
+		if e.bn == 255 {
+			e.writeBlock()
+		}
+		e.bits >>= 8
+		e.nBits -= 8
+	}
+}
+
+// writeBlock writes out the current sub-block.
+func (e *lzwEncoder) writeBlock() {
+	if e.err == nil {
+		e.block[0] = uint8(e.bn)
+		_, e.err = e.w.Write(e.block[:1+e.bn])
+	}
+	e.bn = 0
+}
+
+// incHi advances hi after a code has been written. It reports whether the
+// table is then full and has been reset, in which case no code is added.
+func (e *lzwEncoder) incHi() bool {
+	if e.frozen {
+		return true
+	}
+	e.hi++
+	if e.hi == e.overflow {
+		e.width++
+		e.overflow <<= 1
+	}
+	if e.hi == e.maxCode {
+		if e.keepFull {
+			// Add this last code, which the decoder adds too, and no more.
+			e.frozen = true
+			return false
+		}
+		e.clear()
+		return true
+	}
+	return false
+}
+
+// encode compresses pix, a row of pixels.
+func (e *lzwEncoder) encode(pix []byte) error {
+	clear := uint32(1) << e.litWidth
+	if e.uncompressed {
+		// Each literal moves the decoder on to its next code, so the table
+		// must be reset before that widens the codes.
+		for _, x := range pix {
+			if uint32(x) >= clear {
+				return errPixelRange
+			}
+			e.writeCode(uint32(x))
+			e.run++
+			if e.run == clear-2 {
+				e.clear()
+			}
+		}
+		return e.err
+	}
+	saved := e.savedCode
+loop:
+	for _, x := range pix {
+		literal := uint32(x)
+		if literal >= clear {
+			e.savedCode = saved
+			return errPixelRange
+		}
+		if saved == lzwInvalidCode {
+			saved = literal
+			continue
+		}
+		key := saved<<8 | literal
+		h := (key>>12 ^ key) & lzwTableMask
+		for t := e.table[h]; t != 0; t = e.table[h] {
+			if key == t>>12 {
+				saved = t & (1<<lzwMaxWidth - 1)
+				continue loop
+			}
+			h = (h + 1) & lzwTableMask
+		}
+		// The pixels so far have no longer code: write it and start again
+		// from this one, adding the pair to the table.
+		e.writeCode(saved)
+		saved = literal
+		if !e.incHi() {
+			e.table[h] = key<<12 | e.hi
+		}
+	}
+	e.savedCode = saved
+	return e.err
+}
+
+// close writes the remaining codes, the end-of-information code and the
+// block terminator.
+func (e *lzwEncoder) close() error {
+	if e.savedCode != lzwInvalidCode {
+		e.writeCode(e.savedCode)
+		e.incHi()
+	}
+	e.writeCode(uint32(1)<<e.litWidth + 1)
+	if e.nBits > 0 {
+		e.bn++
+		e.block[e.bn] = uint8(e.bits)
+	}
+	if e.bn > 0 {
+		e.writeBlock()
+	}
+	if e.err == nil {
+		e.err = e.w.WriteByte(0x00)
+	}
+	return e.err
+}
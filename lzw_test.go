@@ -0,0 +1,304 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// lzwBlocks compresses pix with compress/lzw and returns it as GIF image
+// data sub-blocks, ending with the block terminator.
+func lzwBlocks(pix []byte, litWidth int) []byte {
+	var c bytes.Buffer
+	w := lzw.NewWriter(&c, lzw.LSB, litWidth)
+	w.Write(pix)
+	w.Close()
+	b := &ImageBlock{}
+	b.SetCompressed(c.Bytes())
+	return b.Data
+}
+
+func TestLZWDecoder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for litWidth := 2; litWidth <= 8; litWidth++ {
+		for _, n := range []int{1, 2, 100, 5000, 100000} {
+			// Runs of a few colors exercise long expansions and the
+			// code == hi special case as well as table resets.
+			pix := make([]byte, n)
+			for i := 0; i < n; {
+				c := uint8(rnd.Intn(1 << uint(litWidth)))
+				for k := rnd.Intn(40); k >= 0 && i < n; k-- {
+					pix[i] = c
+					i++
+				}
+			}
+			var d lzwDecoder
+			got := make([]byte, n)
+			d.reset(bufio.NewReader(bytes.NewReader(lzwBlocks(pix, litWidth))), got, n, n, litWidth, 256, true)
+			if err := d.fill(n); err != nil {
+				t.Errorf("litWidth=%d n=%d: fill: %v", litWidth, n, err)
+				continue
+			}
+			if err := d.exhausted(); err != nil {
+				t.Errorf("litWidth=%d n=%d: exhausted: %v", litWidth, n, err)
+			}
+			if !bytes.Equal(got, pix) {
+				t.Errorf("litWidth=%d n=%d: pixels differ", litWidth, n)
+			}
+		}
+	}
+}
+
+func TestLZWDecoderStride(t *testing.T) {
+	// Expansions cross the row ends, which are stride bytes apart.
+	const dx, dy, stride = 37, 29, 50
+	rnd := rand.New(rand.NewSource(1))
+	pix := make([]byte, dx*dy)
+	for i := 0; i < len(pix); {
+		c := uint8(rnd.Intn(4))
+		for k := rnd.Intn(100); k >= 0 && i < len(pix); k-- {
+			pix[i] = c
+			i++
+		}
+	}
+	dst := make([]byte, (dy-1)*stride+dx)
+	for i := range dst {
+		dst[i] = 0xff
+	}
+	var d lzwDecoder
+	d.reset(bufio.NewReader(bytes.NewReader(lzwBlocks(pix, 2))), dst, dx, stride, 2, 4, true)
+	if err := d.fill(len(pix)); err != nil {
+		t.Fatalf("fill: %v", err)
+	}
+	if err := d.exhausted(); err != nil {
+		t.Fatalf("exhausted: %v", err)
+	}
+	for y := 0; y < dy; y++ {
+		if !bytes.Equal(dst[y*stride:y*stride+dx], pix[y*dx:(y+1)*dx]) {
+			t.Errorf("row %d differs", y)
+		}
+		if y < dy-1 && !bytes.Equal(dst[y*stride+dx:(y+1)*stride], bytes.Repeat([]byte{0xff}, stride-dx)) {
+			t.Errorf("the gap after row %d was written to", y)
+		}
+	}
+}
+
+func TestLZWDecoderErrors(t *testing.T) {
+	pix := []byte{0, 1, 2, 3, 3, 3, 3, 2, 1, 0}
+	data := lzwBlocks(pix, 2)
+	testCases := []struct {
+		desc     string
+		data     []byte
+		n        int
+		numColor int
+		fillErr  error
+		exhErr   error
+	}{
+		{"ok", data, len(pix), 4, nil, nil},
+		{"bad pixel", data, len(pix), 3, errBadPixel, nil},
+		{"not enough", data, len(pix) + 1, 4, io.ErrUnexpectedEOF, nil},
+		{"too much", data, len(pix) - 1, 4, nil, errTooMuch},
+		{"truncated", data[:len(data)-2], len(pix), 4, io.ErrUnexpectedEOF, nil},
+		{"extra block", append(data[:len(data)-1:len(data)-1], 1, 0, 0), len(pix), 4, nil, errTooMuch},
+		{"invalid code", []byte{1, 0x3f, 0}, 4, 4, errInvalidCode, nil},
+	}
+	for _, tc := range testCases {
+		var d lzwDecoder
+		d.reset(bufio.NewReader(bytes.NewReader(tc.data)), make([]byte, tc.n), tc.n, tc.n, 2, tc.numColor, true)
+		if err := d.fill(tc.n); err != tc.fillErr {
+			t.Errorf("%s: fill: got %v, want %v", tc.desc, err, tc.fillErr)
+			continue
+		}
+		if tc.fillErr != nil {
+			continue
+		}
+		if err := d.exhausted(); err != tc.exhErr {
+			t.Errorf("%s: exhausted: got %v, want %v", tc.desc, err, tc.exhErr)
+		}
+	}
+}
+
+func TestLZWEncoder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	options := []LZWOptions{
+		{},
+		{MaxCodeWidth: 9},
+		{KeepFullTable: true},
+		{Uncompressed: true},
+	}
+	for litWidth := 2; litWidth <= 8; litWidth++ {
+		for _, n := range []int{0, 1, 100, 5000, 100000} {
+			pix := make([]byte, n)
+			for i := 0; i < n; {
+				c := uint8(rnd.Intn(1 << uint(litWidth)))
+				for k := rnd.Intn(40); k >= 0 && i < n; k-- {
+					pix[i] = c
+					i++
+				}
+			}
+			for _, o := range options {
+				var buf bytes.Buffer
+				w := bufio.NewWriter(&buf)
+				var e lzwEncoder
+				e.reset(w, litWidth, &o)
+				// Encode in rows of varying length.
+				for p := pix; len(p) > 0; {
+					k := min(len(p), 1+rnd.Intn(1000))
+					if err := e.encode(p[:k]); err != nil {
+						t.Fatal(err)
+					}
+					p = p[k:]
+				}
+				if err := e.close(); err != nil {
+					t.Fatal(err)
+				}
+				w.Flush()
+				data := buf.Bytes()
+				if o == (LZWOptions{}) {
+					if want := lzwBlocks(pix, litWidth); !bytes.Equal(data, want) {
+						t.Errorf("litWidth=%d n=%d: output differs from compress/lzw", litWidth, n)
+					}
+				}
+				b := &ImageBlock{Data: data}
+				got, err := ioutil.ReadAll(lzw.NewReader(bytes.NewReader(b.Compressed()), lzw.LSB, litWidth))
+				if err != nil {
+					t.Errorf("litWidth=%d n=%d %+v: %v", litWidth, n, o, err)
+					continue
+				}
+				if !bytes.Equal(got, pix) {
+					t.Errorf("litWidth=%d n=%d %+v: pixels differ", litWidth, n, o)
+				}
+			}
+		}
+	}
+}
+
+func TestLZWEncoderPixelRange(t *testing.T) {
+	var e lzwEncoder
+	e.reset(bufio.NewWriter(ioutil.Discard), 2, &LZWOptions{})
+	if err := e.encode([]byte{0, 1, 4}); err != errPixelRange {
+		t.Errorf("got %v, want %v", err, errPixelRange)
+	}
+}
+
+// scapeImageData returns the image blocks of testdata/scape.gif.
+func scapeImageData(b *testing.B) []*ImageBlock {
+	data, err := ioutil.ReadFile("testdata/scape.gif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var blocks []*ImageBlock
+	tr := NewTokenizer(bytes.NewReader(data))
+	for {
+		tok, err := tr.Next()
+		if err == io.EOF {
+			return blocks
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if t, ok := tok.(*ImageBlock); ok {
+			blocks = append(blocks, t)
+		}
+	}
+}
+
+func BenchmarkLZWDecoder(b *testing.B) {
+	blocks := scapeImageData(b)
+	var d lzwDecoder
+	pix := make([]byte, 1<<20)
+	r := bufio.NewReader(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, t := range blocks {
+			n := t.Width * t.Height
+			r.Reset(bytes.NewReader(t.Data))
+			d.reset(r, pix[:n], t.Width, t.Width, int(t.LitWidth), 256, true)
+			if err := d.fill(n); err != nil {
+				b.Fatal(err)
+			}
+			if err := d.exhausted(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkLZWReader decodes the same data as BenchmarkLZWDecoder with
+// compress/lzw, for comparison.
+func BenchmarkLZWReader(b *testing.B) {
+	blocks := scapeImageData(b)
+	compressed := make([][]byte, len(blocks))
+	for i, t := range blocks {
+		compressed[i] = t.Compressed()
+	}
+	pix := make([]byte, 1<<20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, t := range blocks {
+			n := t.Width * t.Height
+			lzwr := lzw.NewReader(bytes.NewReader(compressed[j]), lzw.LSB, int(t.LitWidth))
+			if _, err := io.ReadFull(lzwr, pix[:n]); err != nil {
+				b.Fatal(err)
+			}
+			lzwr.Close()
+		}
+	}
+}
+
+// scapePixels returns the pixels of the frames of testdata/scape.gif.
+func scapePixels(b *testing.B) [][]byte {
+	g, err := readGIF("testdata/scape.gif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pix := make([][]byte, len(g.Image))
+	for i, m := range g.Image {
+		pix[i] = m.Pix
+	}
+	return pix
+}
+
+func BenchmarkLZWEncoder(b *testing.B) {
+	frames := scapePixels(b)
+	w := bufio.NewWriter(ioutil.Discard)
+	var e lzwEncoder
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pix := range frames {
+			e.reset(w, 8, &LZWOptions{})
+			e.encode(pix)
+			if err := e.close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkLZWWriter encodes the same pixels as BenchmarkLZWEncoder with
+// compress/lzw, for comparison.
+func BenchmarkLZWWriter(b *testing.B) {
+	frames := scapePixels(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pix := range frames {
+			w := lzw.NewWriter(ioutil.Discard, lzw.LSB, 8)
+			w.Write(pix)
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"sort"
+	"math/bits"
 )
 
 const (
@@ -30,10 +30,14 @@ func max(x, y int) int {
 	return y
 }
 
-type point [numDimensions]int
+// A point is a color, with the number of pixels of that color.
+type point struct {
+	c [numDimensions]int
+	n int
+}
 
 type block struct {
-	minCorner, maxCorner point
+	minCorner, maxCorner [numDimensions]int
 	points               []point
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int // The index of the item in the heap.
@@ -41,8 +45,8 @@ type block struct {
 
 func newBlock(p []point) *block {
 	return &block{
-		minCorner: point{0x00, 0x00, 0x00},
-		maxCorner: point{0xFF, 0xFF, 0xFF},
+		minCorner: [numDimensions]int{0x00, 0x00, 0x00},
+		maxCorner: [numDimensions]int{0xFF, 0xFF, 0xFF},
 		points:    p,
 	}
 }
@@ -66,33 +70,183 @@ func (b *block) longestSideLength() int {
 }
 
 func (b *block) shrink() {
-	for j := 0; j < numDimensions; j++ {
-		b.minCorner[j] = b.points[0][j]
-		b.maxCorner[j] = b.points[0][j]
-	}
+	b.minCorner = b.points[0].c
+	b.maxCorner = b.points[0].c
 	for i := 1; i < len(b.points); i++ {
 		for j := 0; j < numDimensions; j++ {
-			b.minCorner[j] = min(b.minCorner[j], b.points[i][j])
-			b.maxCorner[j] = max(b.maxCorner[j], b.points[i][j])
+			b.minCorner[j] = min(b.minCorner[j], b.points[i].c[j])
+			b.maxCorner[j] = max(b.maxCorner[j], b.points[i].c[j])
+		}
+	}
+}
+
+// splitMedian reorders points along axis and returns where to split them
+// in two, at their median weighted by pixel count. The points with the
+// median's value along the axis are kept together, on whichever side
+// leaves the halves closer in pixel count, unless that would leave one of
+// them empty.
+//
+// It is introselect: a quickselect of the median pixel with a
+// median-of-three pivot, switching to the median of medians as the pivot
+// if the partitions keep coming out lopsided. That pivot leaves at most
+// 7/10 of the points on either side, so the whole is linear in
+// len(points) even on the worst input.
+func splitMedian(points []point, axis int) int {
+	return selectSplit(points, axis, 2*bits.Len(uint(len(points))))
+}
+
+// selectSplit is splitMedian with the number of median-of-three pivots to
+// try before taking the median of medians.
+func selectSplit(points []point, axis, budget int) int {
+	total := 0
+	for i := range points {
+		total += points[i].n
+	}
+	median := total / 2
+	// The median pixel is in points[lo:hi], after below pixels.
+	lo, hi, below := 0, len(points), 0
+	var values []int // Scratch space for medianOfMedians.
+	for {
+		var pivot int
+		if budget > 0 {
+			budget--
+			pivot = medianOf3(points[lo].c[axis], points[lo+(hi-lo)/2].c[axis], points[hi-1].c[axis])
+		} else {
+			values = values[:0]
+			for i := lo; i < hi; i++ {
+				values = append(values, points[i].c[axis])
+			}
+			pivot = medianOfMedians(values)
+		}
+		// Partition into points[lo:lt] less than the pivot, points[lt:gt]
+		// equal to it and points[gt:hi] greater, counting their pixels.
+		lt, i, gt := lo, lo, hi
+		nlt, neq := 0, 0
+		for i < gt {
+			switch v := points[i].c[axis]; {
+			case v < pivot:
+				nlt += points[i].n
+				points[lt], points[i] = points[i], points[lt]
+				lt++
+				i++
+			case v > pivot:
+				gt--
+				points[gt], points[i] = points[i], points[gt]
+			default:
+				neq += points[i].n
+				i++
+			}
+		}
+		switch {
+		case median < below+nlt:
+			hi = lt
+		case median < below+nlt+neq:
+			return chooseSplit(lt, gt, below+nlt, below+nlt+neq, median, total, len(points))
+		default:
+			below += nlt + neq
+			lo = gt
 		}
 	}
 }
 
-type pointSorter struct {
-	points []point
-	by     func(p1, p2 *point) bool
+// chooseSplit returns where to split points around the run points[i:j] of
+// equal values holding the median pixel, with below pixels before it and
+// through pixels up to its end.
+func chooseSplit(i, j, below, through, median, total, n int) int {
+	switch {
+	case below == 0 && through == total:
+		// All the points have the same value.
+		return n / 2
+	case below == 0:
+		return j
+	case through == total:
+		return i
+	case median-below <= through-median:
+		return i
+	}
+	return j
 }
 
-func (p *pointSorter) Len() int {
-	return len(p.points)
+// medianOfMedians returns a value of a that is no less than 3/10 of them
+// and no greater than another 3/10: the median of the medians of groups of
+// five. It reorders a.
+func medianOfMedians(a []int) int {
+	for {
+		if len(a) <= 5 {
+			insertionSort(a)
+			return a[len(a)/2]
+		}
+		// Move the median of each group to the front, and take theirs.
+		m := 0
+		for i := 0; i < len(a); i += 5 {
+			g := a[i:min(i+5, len(a))]
+			insertionSort(g)
+			a[m], g[len(g)/2] = g[len(g)/2], a[m]
+			m++
+		}
+		a = a[:m]
+		if m <= 5 {
+			continue
+		}
+		// Select the median of the medians exactly, by quickselect with
+		// their own median of medians as the pivot.
+		return selectInt(a, m/2)
+	}
 }
 
-func (p *pointSorter) Swap(i, j int) {
-	p.points[i], p.points[j] = p.points[j], p.points[i]
+// selectInt returns the k'th smallest value of a, reordering a.
+func selectInt(a []int, k int) int {
+	for len(a) > 5 {
+		// The partition below does not mind the order medianOfMedians
+		// leaves a in.
+		pivot := medianOfMedians(a)
+		lt, gt := 0, len(a)
+		for i := 0; i < gt; {
+			switch {
+			case a[i] < pivot:
+				a[lt], a[i] = a[i], a[lt]
+				lt++
+				i++
+			case a[i] > pivot:
+				gt--
+				a[gt], a[i] = a[i], a[gt]
+			default:
+				i++
+			}
+		}
+		switch {
+		case k < lt:
+			a = a[:lt]
+		case k < gt:
+			return pivot
+		default:
+			a, k = a[gt:], k-gt
+		}
+	}
+	insertionSort(a)
+	return a[k]
+}
+
+// insertionSort sorts a, which is short.
+func insertionSort(a []int) {
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && a[j] < a[j-1]; j-- {
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
 }
 
-func (p *pointSorter) Less(i, j int) bool {
-	return p.by(&p.points[i], &p.points[j])
+func medianOf3(a, b, c int) int {
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b = c
+	}
+	if a > b {
+		return a
+	}
+	return b
 }
 
 // A priorityQueue implements heap.Interface and holds blocks.
@@ -126,14 +280,6 @@ func (pq *priorityQueue) Pop() interface{} {
 	return item
 }
 
-func (pq *priorityQueue) top() interface{} {
-	n := len(*pq)
-	if n == 0 {
-		return nil
-	}
-	return (*pq)[n-1]
-}
-
 // clip clips r against each image's bounds (after translating into
 // the destination image's co-ordinate space) and shifts the point
 // sp by the same amount as the change in r.Min.
@@ -157,11 +303,25 @@ func clip(dst draw.Image, r *image.Rectangle, src image.Image, sp *image.Point)
 // the resulting color is computed by averaging those within
 // each grouping.
 type MedianCutQuantizer struct {
+	// NumColor is the most colors the palette may have, transparent
+	// entry included. Zero or a negative number means 256, so the zero
+	// MedianCutQuantizer makes a full palette rather than an empty one.
 	NumColor int
+	// AlphaThreshold, if non-zero, makes the quantizer alpha-aware. Pixels
+	// with an alpha, from 0 to 0xffff, below it are transparent and share
+	// one fully transparent palette entry, the last, unless NumColor is 1
+	// and there are visible pixels to take the one color. The other colors
+	// are chosen from the visible pixels only, with their alpha
+	// premultiplication undone, and are opaque.
+	AlphaThreshold uint16
+	// Dither says how to dither the pixels mapped to the palette. The
+	// zero value maps each to the nearest color.
+	Dither Dither
 }
 
-func (q *MedianCutQuantizer) medianCut(points []point) color.Palette {
-	if q.NumColor == 0 {
+// medianCut returns a palette of at most numColor colors for points.
+func medianCut(points []point, numColor int) color.Palette {
+	if numColor == 0 {
 		return color.Palette{}
 	}
 
@@ -171,17 +331,10 @@ func (q *MedianCutQuantizer) medianCut(points []point) color.Palette {
 	heap.Init(pq)
 	heap.Push(pq, initialBlock)
 
-	for pq.Len() < q.NumColor && len(pq.top().(*block).points) > 1 {
+	for pq.Len() < numColor && len((*pq)[0].points) > 1 {
 		longestBlock := heap.Pop(pq).(*block)
 		points := longestBlock.points
-		li := longestBlock.longestSideIndex()
-		// TODO: Instead of sorting the entire slice, finding the median using an
-		// algorithm like introselect would give much better performance.
-		sort.Sort(&pointSorter{
-			points: points,
-			by:     func(p1, p2 *point) bool { return p1[li] < p2[li] },
-		})
-		median := len(points) / 2
+		median := splitMedian(points, longestBlock.longestSideIndex())
 		block1 := newBlock(points[:median])
 		block2 := newBlock(points[median:])
 		block1.shrink()
@@ -190,65 +343,139 @@ func (q *MedianCutQuantizer) medianCut(points []point) color.Palette {
 		heap.Push(pq, block2)
 	}
 
-	palette := make(color.Palette, q.NumColor)
+	palette := make(color.Palette, numColor)
 	var n int
 	for n = 0; pq.Len() > 0; n++ {
 		block := heap.Pop(pq).(*block)
 		var sum [numDimensions]int
+		count := 0
 		for i := 0; i < len(block.points); i++ {
 			for j := 0; j < numDimensions; j++ {
-				sum[j] += block.points[i][j]
+				sum[j] += block.points[i].c[j] * block.points[i].n
 			}
+			count += block.points[i].n
 		}
 		palette[n] = color.RGBA64{
-			R: uint16(sum[0] / len(block.points)),
-			G: uint16(sum[1] / len(block.points)),
-			B: uint16(sum[2] / len(block.points)),
+			R: uint16(sum[0] / count),
+			G: uint16(sum[1] / count),
+			B: uint16(sum[2] / count),
 			A: 0xFFFF,
 		}
 	}
 	// Trim to only the colors present in the image, which
-	// could be less than NumColor.
+	// could be less than numColor.
 	return palette[:n]
 }
 
+// Quantize sets dst.Palette to at most NumColor colors chosen for the
+// pixels of src from sp, and maps those pixels to them in the rectangle r
+// of dst.
 func (q *MedianCutQuantizer) Quantize(dst *image.Paletted, r image.Rectangle, src image.Image, sp image.Point) {
 	clip(dst, &r, src, &sp)
 	if r.Empty() {
 		return
 	}
 
-	points := make([]point, r.Dx()*r.Dy())
-	colorSet := make(map[uint32]color.Color, q.NumColor)
-	i := 0
-	for y := r.Min.Y; y < r.Max.Y; y++ {
-		for x := r.Min.X; x < r.Max.X; x++ {
-			c := src.At(x, y)
-			r, g, b, _ := c.RGBA()
-			colorSet[(r>>8)<<16|(g>>8)<<8|b>>8] = c
-			points[i][0] = int(r)
-			points[i][1] = int(g)
-			points[i][2] = int(b)
-			i++
+	colors := newColorSet(q.NumColor)
+	var hist colorHistogram
+	transparent := readColors(r, src, sp, q.AlphaThreshold, func(c color.RGBA64, n int) {
+		colors.add(c)
+		hist.add(c, n)
+	})
+	setPalette(dst, colors, q.NumColor, transparent, func(numColor int) color.Palette {
+		return medianCut(hist.points(), numColor)
+	})
+	remap(dst, r, src, sp, q.AlphaThreshold, &q.Dither)
+}
+
+// colorSet collects the distinct colors of an image, as far as 8 bits per
+// channel tell them apart, up to a limit past which only the fact that
+// there are more matters.
+type colorSet struct {
+	colors map[uint32]color.Color
+	// order holds the colors in the order they were first added, so that
+	// a palette made of them does not depend on the map's order.
+	order []color.Color
+	limit int
+	// full is set once there are more than limit colors.
+	full bool
+	// last is the last color added, as neighboring pixels are often the
+	// same.
+	last    color.RGBA64
+	hasLast bool
+}
+
+func newColorSet(limit int) *colorSet {
+	return &colorSet{colors: make(map[uint32]color.Color), limit: paletteSize(limit)}
+}
+
+func (s *colorSet) add(c color.RGBA64) {
+	if s.full || (s.hasLast && c == s.last) {
+		return
+	}
+	s.last, s.hasLast = c, true
+	key := uint32(c.R>>8)<<16 | uint32(c.G>>8)<<8 | uint32(c.B>>8)
+	if _, ok := s.colors[key]; ok {
+		return
+	}
+	s.colors[key] = c
+	s.order = append(s.order, c)
+	if len(s.colors) > s.limit {
+		s.full = true
+	}
+}
+
+// colorHistogram counts the pixels of each distinct color, ignoring alpha.
+// It is a hash table with linear probing.
+type colorHistogram struct {
+	// keys holds the colors, 16 bits per channel, with bit 63 set, or 0
+	// for unused entries.
+	keys   []uint64
+	counts []int
+	n      int
+}
+
+// add counts n more pixels of color c.
+func (h *colorHistogram) add(c color.RGBA64, n int) {
+	if 2*(h.n+1) > len(h.keys) {
+		h.grow()
+	}
+	key := 1<<63 | uint64(c.R)<<32 | uint64(c.G)<<16 | uint64(c.B)
+	mask := uint64(len(h.keys) - 1)
+	i := (key * 0x9e3779b97f4a7c15 >> 32) & mask
+	for h.keys[i] != key {
+		if h.keys[i] == 0 {
+			h.keys[i] = key
+			h.n++
+			break
 		}
+		i = (i + 1) & mask
 	}
-	if len(colorSet) <= q.NumColor {
-		// No need to quantize since the total number of colors
-		// fits within the palette.
-		dst.Palette = make(color.Palette, len(colorSet))
-		i := 0
-		for _, c := range colorSet {
-			dst.Palette[i] = c
-			i++
+	h.counts[i] += n
+}
+
+// grow doubles the size of the table.
+func (h *colorHistogram) grow() {
+	keys, counts := h.keys, h.counts
+	size := max(2*len(keys), 1<<10)
+	h.keys, h.counts, h.n = make([]uint64, size), make([]int, size), 0
+	for i, key := range keys {
+		if key != 0 {
+			h.add(color.RGBA64{uint16(key >> 32), uint16(key >> 16), uint16(key), 0}, counts[i])
 		}
-	} else {
-		dst.Palette = q.medianCut(points)
 	}
+}
 
-	for y := 0; y < r.Dy(); y++ {
-		for x := 0; x < r.Dx(); x++ {
-			// TODO: this should be done more efficiently.
-			dst.Set(sp.X+x, sp.Y+y, src.At(r.Min.X+x, r.Min.Y+y))
+// points returns the colors counted, with their counts.
+func (h *colorHistogram) points() []point {
+	points := make([]point, 0, h.n)
+	for i, key := range h.keys {
+		if key != 0 {
+			points = append(points, point{
+				c: [numDimensions]int{int(uint16(key >> 32)), int(uint16(key >> 16)), int(uint16(key))},
+				n: h.counts[i],
+			})
 		}
 	}
+	return points
 }
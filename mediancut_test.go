@@ -0,0 +1,446 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// opaqueImage hides the concrete type of an image, so that it is read
+// through At.
+type opaqueImage struct {
+	image.Image
+}
+
+// testImages returns an image of each type with a fast path, filled with
+// random colors, with bounds not at the origin.
+func testImages(r image.Rectangle) []image.Image {
+	rnd := rand.New(rand.NewSource(1))
+	rgba := image.NewRGBA(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(rnd.Intn(256))
+	}
+	nrgba := image.NewNRGBA(r)
+	copy(nrgba.Pix, rgba.Pix)
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	for _, p := range [][]byte{ycbcr.Y, ycbcr.Cb, ycbcr.Cr} {
+		for i := range p {
+			p[i] = uint8(rnd.Intn(256))
+		}
+	}
+	palette := make(color.Palette, 200)
+	for i := range palette {
+		palette[i] = color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+	}
+	paletted := image.NewPaletted(r, palette)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rnd.Intn(len(palette)))
+	}
+	return []image.Image{rgba, nrgba, ycbcr, paletted}
+}
+
+func TestQuantizeFastPaths(t *testing.T) {
+	bounds := image.Rect(3, 5, 70, 60)
+	for _, src := range testImages(bounds) {
+		// Quantize part of the image into a destination elsewhere.
+		r := image.Rect(10, 10, 50, 40)
+		sp := image.Pt(20, 15)
+		q := &MedianCutQuantizer{NumColor: 16}
+		want := image.NewPaletted(image.Rect(0, 0, 60, 50), nil)
+		q.Quantize(want, r, opaqueImage{src}, sp)
+		got := image.NewPaletted(want.Rect, nil)
+		q.Quantize(got, r, src, sp)
+		if len(got.Palette) != len(want.Palette) {
+			t.Errorf("%T: got %d colors, want %d", src, len(got.Palette), len(want.Palette))
+			continue
+		}
+		for i := range got.Palette {
+			if got.Palette[i] != want.Palette[i] {
+				t.Errorf("%T: palette entry %d: got %v, want %v", src, i, got.Palette[i], want.Palette[i])
+				break
+			}
+		}
+		for i := range got.Pix {
+			if got.Pix[i] != want.Pix[i] {
+				t.Errorf("%T: pixel %d: got %d, want %d", src, i, got.Pix[i], want.Pix[i])
+				break
+			}
+		}
+		// The pixels must be those of the nearest palette colors.
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := src.At(sp.X+x-r.Min.X, sp.Y+y-r.Min.Y)
+				if got, want := got.ColorIndexAt(x, y), uint8(got.Palette.Index(c)); got != want {
+					t.Fatalf("%T: pixel (%d, %d): got index %d, want %d", src, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantizeFewColorsDeterministic(t *testing.T) {
+	// Colors that fit in the palette keep the order they first appear in,
+	// the same every time.
+	want := color.Palette{
+		color.RGBA64{0xffff, 0, 0, 0xffff},
+		color.RGBA64{0, 0xffff, 0, 0xffff},
+		color.RGBA64{0, 0, 0xffff, 0xffff},
+		color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff},
+		color.RGBA64{0, 0, 0, 0xffff},
+	}
+	src := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := 0; i < 20*10; i++ {
+		src.Set(i%20, i/20, want[i/40])
+	}
+	for i := 0; i < 10; i++ {
+		dst := image.NewPaletted(src.Bounds(), nil)
+		(&MedianCutQuantizer{NumColor: 16}).Quantize(dst, dst.Rect, src, image.ZP)
+		if !reflect.DeepEqual(dst.Palette, want) {
+			t.Fatalf("run %d: got palette %v, want %v", i, dst.Palette, want)
+		}
+	}
+}
+
+// frame1080p returns a smooth image, more like a video frame than random
+// noise.
+func frame1080p() *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+	for y := 0; y < 1080; y++ {
+		for x := 0; x < 1920; x++ {
+			m.SetRGBA(x, y, color.RGBA{uint8(x / 8), uint8(y / 5), uint8((x + y) / 12), 0xff})
+		}
+	}
+	draw.Draw(m, image.Rect(500, 300, 900, 700), image.NewUniform(color.RGBA{0xff, 0x80, 0x20, 0xff}), image.ZP, draw.Src)
+	return m
+}
+
+// noise1080p returns an image of random opaque colors, with as many
+// distinct colors as a 1080p frame can have.
+func noise1080p() *image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(rnd.Intn(256))
+		if i%4 == 3 {
+			m.Pix[i] = 0xff
+		}
+	}
+	return m
+}
+
+// quantizeError returns the root mean square difference, per 8-bit
+// channel, between m and m quantized into dst.
+func quantizeError(dst *image.Paletted, m *image.RGBA) float64 {
+	sum := 0.0
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := m.RGBAAt(x, y)
+			q := dst.Palette[dst.ColorIndexAt(x, y)]
+			r, g, b, _ := q.RGBA()
+			dr := float64(c.R) - float64(r>>8)
+			dg := float64(c.G) - float64(g>>8)
+			db := float64(c.B) - float64(b>>8)
+			sum += dr*dr + dg*dg + db*db
+		}
+	}
+	return math.Sqrt(sum / float64(3*b.Dx()*b.Dy()))
+}
+
+// benchmarkQuantizer quantizes m with q, and reports the error of the
+// result as well as the time taken.
+func benchmarkQuantizer(b *testing.B, q Quantizer, m *image.RGBA) {
+	dst := image.NewPaletted(m.Bounds(), nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Quantize(dst, m.Bounds(), m, image.ZP)
+	}
+	b.StopTimer()
+	b.ReportMetric(quantizeError(dst, m), "rmse")
+}
+
+func BenchmarkQuantize1080p(b *testing.B) {
+	benchmarkQuantizer(b, &MedianCutQuantizer{NumColor: 256}, frame1080p())
+}
+
+func BenchmarkQuantizeNoise1080p(b *testing.B) {
+	benchmarkQuantizer(b, &MedianCutQuantizer{NumColor: 256}, noise1080p())
+}
+
+// pointsByAxis sorts points along one axis.
+type pointsByAxis struct {
+	points []point
+	axis   int
+}
+
+func (p pointsByAxis) Len() int           { return len(p.points) }
+func (p pointsByAxis) Swap(i, j int)      { p.points[i], p.points[j] = p.points[j], p.points[i] }
+func (p pointsByAxis) Less(i, j int) bool { return p.points[i].c[p.axis] < p.points[j].c[p.axis] }
+
+// randomPoints returns n points with values in [0, limit) and pixel
+// counts from 1 to 4.
+func randomPoints(rnd *rand.Rand, n, limit int) []point {
+	points := make([]point, n)
+	for i := range points {
+		for j := range points[i].c {
+			points[i].c[j] = rnd.Intn(limit)
+		}
+		points[i].n = 1 + rnd.Intn(4)
+	}
+	return points
+}
+
+func TestSplitMedian(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{2, 3, 10, 1000, 100000} {
+		// Few distinct values make many ties.
+		for _, limit := range []int{1, 2, 5, 1 << 16} {
+			for axis := 0; axis < numDimensions; axis++ {
+				points := randomPoints(rnd, n, limit)
+				// Find the expected split from the sorted points.
+				sorted := append([]point(nil), points...)
+				sort.Sort(pointsByAxis{sorted, axis})
+				total := 0
+				for _, p := range sorted {
+					total += p.n
+				}
+				var want int
+				for i, below := 0, 0; ; {
+					j, through := i, below
+					for ; j < n && sorted[j].c[axis] == sorted[i].c[axis]; j++ {
+						through += sorted[j].n
+					}
+					if total/2 < through {
+						want = chooseSplit(i, j, below, through, total/2, total, n)
+						break
+					}
+					i, below = j, through
+				}
+
+				// A budget of 0 takes the median of medians at once.
+				for _, budget := range []int{-1, 0} {
+					points := append([]point(nil), points...)
+					m := 0
+					if budget < 0 {
+						m = splitMedian(points, axis)
+					} else {
+						m = selectSplit(points, axis, budget)
+					}
+					if m != want {
+						t.Fatalf("n=%d limit=%d axis=%d budget=%d: split at %d, want %d", n, limit, axis, budget, m, want)
+					}
+					if m <= 0 || m >= n {
+						t.Fatalf("n=%d limit=%d: split at %d", n, limit, m)
+					}
+					if sorted[0].c[axis] == sorted[n-1].c[axis] {
+						continue
+					}
+					// Equal values must not straddle the split.
+					lo, hi := points[0].c[axis], points[m].c[axis]
+					for _, p := range points[:m] {
+						lo = max(lo, p.c[axis])
+					}
+					for _, p := range points[m:] {
+						hi = min(hi, p.c[axis])
+					}
+					if lo >= hi {
+						t.Fatalf("n=%d limit=%d: halves overlap: %d >= %d", n, limit, lo, hi)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestMedianOfMedians(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 5, 6, 26, 1000, 12345} {
+		a := make([]int, n)
+		for i := range a {
+			a[i] = rnd.Intn(100)
+		}
+		sorted := append([]int(nil), a...)
+		sort.Ints(sorted)
+		pivot := medianOfMedians(append([]int(nil), a...))
+		below, above := sort.SearchInts(sorted, pivot), n-sort.SearchInts(sorted, pivot+1)
+		if 10*(n-above) < 3*n || 10*(n-below) < 3*n {
+			t.Errorf("n=%d: pivot %d has %d values below and %d above", n, pivot, below, above)
+		}
+		for _, k := range []int{0, n / 3, n / 2, n - 1} {
+			if got := selectInt(append([]int(nil), a...), k); got != sorted[k] {
+				t.Errorf("n=%d: selectInt(%d) = %d, want %d", n, k, got, sorted[k])
+			}
+		}
+	}
+}
+
+func BenchmarkSplitMedian(b *testing.B) {
+	points := randomPoints(rand.New(rand.NewSource(1)), 1<<20, 256)
+	work := make([]point, len(points))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(work, points)
+		splitMedian(work, i%numDimensions)
+	}
+}
+
+// BenchmarkSortMedian splits the same points as BenchmarkSplitMedian by
+// sorting them, as medianCut used to.
+func BenchmarkSortMedian(b *testing.B) {
+	points := randomPoints(rand.New(rand.NewSource(1)), 1<<20, 256)
+	work := make([]point, len(points))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(work, points)
+		sort.Sort(pointsByAxis{work, i % numDimensions})
+	}
+}
+
+// sticker returns an image with a transparent background, a
+// half-transparent border and an opaque gradient inside, with numColor
+// colors or more.
+func sticker(numColor int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 8; y < 56; y++ {
+		for x := 8; x < 56; x++ {
+			c := color.NRGBA{uint8(x * 4), uint8(y * 4), uint8((x*y)%numColor) * 0x10, 0xff}
+			if x < 12 || x >= 52 || y < 12 || y >= 52 {
+				c = color.NRGBA{0x20, 0x40, 0xc0, 0x80}
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestQuantizeAlpha(t *testing.T) {
+	for _, numColor := range []int{4, 16, 256} {
+		src := sticker(numColor)
+		dst := image.NewPaletted(src.Bounds(), nil)
+		q := &MedianCutQuantizer{NumColor: numColor, AlphaThreshold: 0x40 * 0x101}
+		q.Quantize(dst, src.Bounds(), src, image.ZP)
+		n := len(dst.Palette)
+		if n > numColor {
+			t.Errorf("NumColor %d: got %d colors", numColor, n)
+		}
+		if _, _, _, a := dst.Palette[n-1].RGBA(); a != 0 {
+			t.Fatalf("NumColor %d: last entry %v is not transparent", numColor, dst.Palette[n-1])
+		}
+		for _, c := range dst.Palette[:n-1] {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				t.Errorf("NumColor %d: entry %v is not opaque", numColor, c)
+			}
+		}
+		if got := dst.ColorIndexAt(0, 0); int(got) != n-1 {
+			t.Errorf("NumColor %d: background: got index %d, want %d", numColor, got, n-1)
+		}
+		// The half-transparent border is visible, with its color as it
+		// was before premultiplication.
+		r, g, b, _ := dst.At(9, 9).RGBA()
+		if r>>8 != 0x20 || g>>8 != 0x40 || b>>8 != 0xc0 {
+			t.Errorf("NumColor %d: border: got %v", numColor, dst.At(9, 9))
+		}
+	}
+}
+
+func TestQuantizersAlpha(t *testing.T) {
+	quantizers := []Quantizer{
+		&MedianCutQuantizer{NumColor: 16, AlphaThreshold: 0x40 * 0x101},
+		&OctreeQuantizer{NumColor: 16, AlphaThreshold: 0x40 * 0x101},
+		&WuQuantizer{NumColor: 16, AlphaThreshold: 0x40 * 0x101},
+		&NeuQuantQuantizer{NumColor: 16, AlphaThreshold: 0x40 * 0x101},
+	}
+	src := sticker(256)
+	for _, q := range quantizers {
+		dst := image.NewPaletted(src.Bounds(), nil)
+		q.Quantize(dst, src.Bounds(), src, image.ZP)
+		n := len(dst.Palette)
+		if n > 16 {
+			t.Errorf("%T: got %d colors", q, n)
+		}
+		if _, _, _, a := dst.Palette[n-1].RGBA(); a != 0 {
+			t.Errorf("%T: last entry %v is not transparent", q, dst.Palette[n-1])
+			continue
+		}
+		if got := dst.ColorIndexAt(0, 0); int(got) != n-1 {
+			t.Errorf("%T: transparent pixel: got index %d, want %d", q, got, n-1)
+		}
+	}
+}
+
+func TestQuantizeAlphaOneColor(t *testing.T) {
+	// A single color goes to the visible pixels, not to a transparent
+	// entry.
+	src := sticker(4)
+	dst := image.NewPaletted(src.Bounds(), nil)
+	q := &MedianCutQuantizer{NumColor: 1, AlphaThreshold: 0x40 * 0x101}
+	q.Quantize(dst, src.Bounds(), src, image.ZP)
+	if len(dst.Palette) != 1 {
+		t.Fatalf("got %d colors, want 1", len(dst.Palette))
+	}
+	if _, _, _, a := dst.Palette[0].RGBA(); a != 0xffff {
+		t.Errorf("entry %v is not opaque", dst.Palette[0])
+	}
+
+	// With no visible pixels, the one color is transparent.
+	clear := image.NewNRGBA(src.Bounds())
+	q.Quantize(dst, src.Bounds(), clear, image.ZP)
+	if len(dst.Palette) != 1 {
+		t.Fatalf("transparent image: got %d colors, want 1", len(dst.Palette))
+	}
+	if _, _, _, a := dst.Palette[0].RGBA(); a != 0 {
+		t.Errorf("transparent image: entry %v is not transparent", dst.Palette[0])
+	}
+}
+
+func TestQuantizeDefaultNumColor(t *testing.T) {
+	src := frame1080p().SubImage(image.Rect(0, 0, 64, 64)).(*image.RGBA)
+	for _, numColor := range []int{0, -1} {
+		q := &MedianCutQuantizer{NumColor: numColor, AlphaThreshold: 0x8000}
+		dst := image.NewPaletted(src.Bounds(), nil)
+		q.Quantize(dst, src.Bounds(), src, image.ZP)
+		want := image.NewPaletted(src.Bounds(), nil)
+		(&MedianCutQuantizer{NumColor: 256, AlphaThreshold: 0x8000}).Quantize(want, src.Bounds(), src, image.ZP)
+		if !reflect.DeepEqual(dst.Palette, want.Palette) || !bytes.Equal(dst.Pix, want.Pix) {
+			t.Errorf("NumColor %d: got %d colors, not as with 256", numColor, len(dst.Palette))
+		}
+	}
+}
+
+func TestEncodeTransparency(t *testing.T) {
+	src := sticker(256)
+	for _, tc := range []struct {
+		o          *Options
+		background uint32
+	}{
+		// By default the quantizer ignores alpha, so every pixel is opaque.
+		{nil, 0xffff},
+		{&Options{Quantizer: &MedianCutQuantizer{NumColor: 256, AlphaThreshold: 0x8000}}, 0},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, src, tc.o); err != nil {
+			t.Fatal(err)
+		}
+		m, err := gif.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, a := m.At(0, 0).RGBA(); a != tc.background {
+			t.Errorf("%+v: background: got alpha %#x, want %#x", tc.o, a, tc.background)
+		}
+		if _, _, _, a := m.At(30, 30).RGBA(); a != 0xffff {
+			t.Errorf("%+v: inside: got alpha %#x, want 0xffff", tc.o, a)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+)
+
+// NeuQuantQuantizer constructs a palette with a maximum of NumColor
+// colors by Anthony Dekker's NeuQuant method: a one-dimensional
+// self-organizing map of NumColor neurons is trained on a sample of the
+// pixels, and the neurons' colors become the palette. It is slower than
+// the other quantizers, and does best on large photographs with palettes
+// of 64 colors or more, sampling many of the pixels. The result depends
+// only on the input.
+type NeuQuantQuantizer struct {
+	// NumColor is as for MedianCutQuantizer.
+	NumColor int
+	// SampleFactor trades quality for speed: one pixel in SampleFactor is
+	// used for training. It ranges from 1, for the best quality, to 30;
+	// zero means 10. Below 10 the extra pixels refine the palette found
+	// at 10, so that quality only improves, at the cost of time.
+	SampleFactor int
+	// AlphaThreshold is as for MedianCutQuantizer.
+	AlphaThreshold uint16
+	// Dither says how to dither the pixels mapped to the palette.
+	Dither Dither
+}
+
+// Quantize sets dst.Palette as well as dst's pixels in r, from the pixels
+// of src starting at sp.
+func (q *NeuQuantQuantizer) Quantize(dst *image.Paletted, r image.Rectangle, src image.Image, sp image.Point) {
+	clip(dst, &r, src, &sp)
+	if r.Empty() {
+		return
+	}
+
+	colors := newColorSet(q.NumColor)
+	// pix holds the visible pixels, 8 bits per channel, in order.
+	var pix []byte
+	transparent := readColors(r, src, sp, q.AlphaThreshold, func(c color.RGBA64, n int) {
+		colors.add(c)
+		for ; n > 0; n-- {
+			pix = append(pix, uint8(c.R>>8), uint8(c.G>>8), uint8(c.B>>8))
+		}
+	})
+	setPalette(dst, colors, q.NumColor, transparent, func(numColor int) color.Palette {
+		sampleFactor := q.SampleFactor
+		if sampleFactor <= 0 || sampleFactor > 30 {
+			sampleFactor = nqSampleFactor
+		}
+		n := newNeuQuant(numColor)
+		n.learn(pix, sampleFactor)
+		return n.palette()
+	})
+
+	remap(dst, r, src, sp, q.AlphaThreshold, &q.Dither)
+}
+
+// The constants of the NeuQuant network, as in Dekker's implementation.
+// Values are fixed point, with the shifts given.
+const (
+	nqCycles       = 100 // Number of learning cycles at nqSampleFactor.
+	nqSampleFactor = 10  // The default sample factor.
+	nqMinPixels    = 503 // Smaller images are learned in full.
+
+	nqNetBiasShift = 4 // Bias for the colors of the neurons.
+	nqIntBiasShift = 16
+	nqIntBias      = 1 << nqIntBiasShift // Bias for fractions.
+	nqGammaShift   = 10
+	nqBetaShift    = 10
+	nqBeta         = nqIntBias >> nqBetaShift // 1/1024.
+	nqBetaGamma    = nqIntBias << (nqGammaShift - nqBetaShift)
+
+	nqRadiusBiasShift = 6
+	nqRadiusBias      = 1 << nqRadiusBiasShift
+	nqRadiusDec       = 30 // The radius shrinks by 1/30 each step.
+
+	nqAlphaBiasShift = 10
+	nqInitAlpha      = 1 << nqAlphaBiasShift
+	nqRadBiasShift   = 8
+	nqRadBias        = 1 << nqRadBiasShift
+	nqAlphaRadBShift = nqAlphaBiasShift + nqRadBiasShift
+	nqAlphaRadBias   = 1 << nqAlphaRadBShift
+)
+
+// neuQuant is a NeuQuant network.
+type neuQuant struct {
+	network [][3]int // The colors of the neurons.
+	bias    []int    // Bias for choosing a neuron, grows when not chosen.
+	freq    []int    // How often each neuron is chosen.
+	// radPower holds the learning rates of the neighbors of the chosen
+	// neuron, by distance.
+	radPower []int
+}
+
+func newNeuQuant(size int) *neuQuant {
+	n := &neuQuant{
+		network:  make([][3]int, size),
+		bias:     make([]int, size),
+		freq:     make([]int, size),
+		radPower: make([]int, size>>3),
+	}
+	// Start along the gray axis.
+	for i := range n.network {
+		v := (i << (nqNetBiasShift + 8)) / size
+		n.network[i] = [3]int{v, v, v}
+		n.freq[i] = nqIntBias / size
+	}
+	return n
+}
+
+// learn trains the network on one in sampleFactor of the pixels in pix,
+// chosen at random with a fixed seed. Dekker steps through the pixels by
+// a prime near 500 instead, which visits only a few columns of a wide
+// image each cycle. Below nqSampleFactor, the first nqCycles cycles are
+// those at nqSampleFactor and the extra samples go to further cycles at
+// the final rates: stretching the cycles instead would keep the radius
+// wide for longer, letting neighbors pile onto large areas of one color.
+func (n *neuQuant) learn(pix []byte, sampleFactor int) {
+	size := len(n.network)
+	if size == 0 || len(pix) == 0 {
+		return
+	}
+	numPixels := len(pix) / 3
+	if numPixels < nqMinPixels {
+		sampleFactor = 1
+	}
+	alphaDec := 30 + (max(sampleFactor, nqSampleFactor)-1)/3
+	samplePixels := numPixels / sampleFactor
+	// Small images keep all their samples in nqCycles cycles.
+	cycle := min(samplePixels, max(numPixels/nqSampleFactor, nqMinPixels))
+	delta := max(cycle/nqCycles, 1)
+	alpha := nqInitAlpha
+	radius := (size >> 3) * nqRadiusBias
+	rad := n.setRadius(radius, alpha)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 1; i <= samplePixels; i++ {
+		pos := 3 * rnd.Intn(numPixels)
+		var c [3]int
+		for k := range c {
+			c[k] = int(pix[pos+k]) << nqNetBiasShift
+		}
+		j := n.contest(c)
+		n.alter(j, alpha, c)
+		if rad != 0 {
+			n.alterNeighbors(j, rad, c)
+		}
+		if i%delta == 0 {
+			alpha -= alpha / alphaDec
+			radius -= radius / nqRadiusDec
+			rad = n.setRadius(radius, alpha)
+		}
+	}
+}
+
+// setRadius sets the learning rates of the neighbors for radius and
+// alpha, and returns the radius in neurons, or 0 if no neighbors learn.
+func (n *neuQuant) setRadius(radius, alpha int) int {
+	rad := radius >> nqRadiusBiasShift
+	if rad <= 1 {
+		return 0
+	}
+	for i := 0; i < rad && i < len(n.radPower); i++ {
+		n.radPower[i] = alpha * ((rad*rad - i*i) * nqRadBias / (rad * rad))
+	}
+	return rad
+}
+
+// contest returns the neuron to learn c: the nearest to it once biased
+// against neurons chosen too often. It updates the frequencies and biases
+// as it goes.
+func (n *neuQuant) contest(c [3]int) int {
+	bestDist, bestBiasDist := int(^uint32(0)>>1), int(^uint32(0)>>1)
+	best, bestBias := -1, -1
+	for i, v := range n.network {
+		dist := abs(v[0]-c[0]) + abs(v[1]-c[1]) + abs(v[2]-c[2])
+		if dist < bestDist {
+			bestDist, best = dist, i
+		}
+		biasDist := dist - n.bias[i]>>(nqIntBiasShift-nqNetBiasShift)
+		if biasDist < bestBiasDist {
+			bestBiasDist, bestBias = biasDist, i
+		}
+		betaFreq := n.freq[i] >> nqBetaShift
+		n.freq[i] -= betaFreq
+		n.bias[i] += betaFreq << nqGammaShift
+	}
+	n.freq[best] += nqBeta
+	n.bias[best] -= nqBetaGamma
+	return bestBias
+}
+
+// alter moves neuron i towards c by alpha.
+func (n *neuQuant) alter(i, alpha int, c [3]int) {
+	v := &n.network[i]
+	for k := range v {
+		v[k] -= alpha * (v[k] - c[k]) / nqInitAlpha
+	}
+}
+
+// alterNeighbors moves the neurons within rad of neuron i towards c, the
+// nearer the more.
+func (n *neuQuant) alterNeighbors(i, rad int, c [3]int) {
+	lo, hi := max(i-rad, -1), min(i+rad, len(n.network))
+	j, k := i+1, i-1
+	for m := 1; j < hi || k > lo; m++ {
+		a := n.radPower[m]
+		if j < hi {
+			v := &n.network[j]
+			for ch := range v {
+				v[ch] -= a * (v[ch] - c[ch]) / nqAlphaRadBias
+			}
+			j++
+		}
+		if k > lo {
+			v := &n.network[k]
+			for ch := range v {
+				v[ch] -= a * (v[ch] - c[ch]) / nqAlphaRadBias
+			}
+			k--
+		}
+	}
+}
+
+// palette returns the colors of the neurons.
+func (n *neuQuant) palette() color.Palette {
+	p := make(color.Palette, len(n.network))
+	for i, v := range n.network {
+		var c [3]uint8
+		for k := range c {
+			x := (v[k] + 1<<(nqNetBiasShift-1)) >> nqNetBiasShift
+			c[k] = uint8(max(0, min(x, 255)))
+		}
+		p[i] = color.RGBA{c[0], c[1], c[2], 0xff}
+	}
+	return p
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
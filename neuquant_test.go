@@ -0,0 +1,97 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestNeuQuantQuantizer(t *testing.T) {
+	m, err := readImg("testdata/teapool.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := image.NewRGBA(m.Bounds())
+	draw.Draw(src, src.Bounds(), m, m.Bounds().Min, draw.Src)
+	for _, numColor := range []int{1, 16, 64, 256} {
+		var errs []float64
+		for _, sampleFactor := range []int{1, 0, 30} {
+			q := &NeuQuantQuantizer{NumColor: numColor, SampleFactor: sampleFactor}
+			dst := image.NewPaletted(src.Bounds(), nil)
+			q.Quantize(dst, src.Bounds(), src, src.Bounds().Min)
+			if n := len(dst.Palette); n == 0 || n > numColor {
+				t.Errorf("NumColor %d SampleFactor %d: got %d colors", numColor, sampleFactor, n)
+			}
+			errs = append(errs, quantizeError(dst, src))
+
+			// The result depends only on the input.
+			again := image.NewPaletted(src.Bounds(), nil)
+			q.Quantize(again, src.Bounds(), src, src.Bounds().Min)
+			for i := range dst.Palette {
+				if dst.Palette[i] != again.Palette[i] {
+					t.Fatalf("NumColor %d SampleFactor %d: palette entry %d differs between runs", numColor, sampleFactor, i)
+				}
+			}
+		}
+		if numColor < 64 {
+			continue
+		}
+		// Sampling every pixel is best, and better than median cut.
+		if errs[0] >= errs[2] {
+			t.Errorf("NumColor %d: error %.2f sampling every pixel, not less than %.2f sampling 1 in 30",
+				numColor, errs[0], errs[2])
+		}
+		want := image.NewPaletted(src.Bounds(), nil)
+		(&MedianCutQuantizer{NumColor: numColor}).Quantize(want, src.Bounds(), src, src.Bounds().Min)
+		if got, want := errs[0], quantizeError(want, src); got >= want {
+			t.Errorf("NumColor %d: error %.2f, not less than median cut's %.2f", numColor, got, want)
+		}
+	}
+
+	// Sampling every pixel is best on a large frame with areas of one
+	// color too.
+	frame := frame1080p()
+	var errs []float64
+	for _, sampleFactor := range []int{1, 10} {
+		dst := image.NewPaletted(frame.Bounds(), nil)
+		(&NeuQuantQuantizer{NumColor: 256, SampleFactor: sampleFactor}).Quantize(dst, frame.Bounds(), frame, image.ZP)
+		errs = append(errs, quantizeError(dst, frame))
+	}
+	if errs[0] >= errs[1] {
+		t.Errorf("1080p: error %.2f sampling every pixel, not less than %.2f sampling 1 in 10", errs[0], errs[1])
+	}
+}
+
+func TestNeuQuantQuantizerClip(t *testing.T) {
+	// Quantize part of an image into a destination elsewhere; pixels
+	// outside the clipped rectangle are left alone.
+	src := testImages(image.Rect(3, 5, 70, 60))[0]
+	dst := image.NewPaletted(image.Rect(0, 0, 60, 50), nil)
+	for i := range dst.Pix {
+		dst.Pix[i] = 0xff
+	}
+	r := image.Rect(10, 10, 80, 80)
+	sp := image.Pt(20, 15)
+	(&NeuQuantQuantizer{NumColor: 64}).Quantize(dst, r, src, sp)
+	clipped := image.Rect(10, 10, 60, 50).Intersect(image.Rect(3, 5, 70, 60).Add(r.Min.Sub(sp)))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 60; x++ {
+			in := image.Pt(x, y).In(clipped)
+			if got := dst.ColorIndexAt(x, y); (got == 0xff) == in {
+				t.Fatalf("(%d, %d): index %d, in clipped rectangle %v", x, y, got, in)
+			}
+		}
+	}
+}
+
+func BenchmarkNeuQuantQuantize1080p(b *testing.B) {
+	benchmarkQuantizer(b, &NeuQuantQuantizer{NumColor: 256}, frame1080p())
+}
+
+func BenchmarkNeuQuantQuantize1080pSample1(b *testing.B) {
+	benchmarkQuantizer(b, &NeuQuantQuantizer{NumColor: 256, SampleFactor: 1}, frame1080p())
+}
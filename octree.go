@@ -0,0 +1,301 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// An OctreeMerge chooses which leaves an OctreeQuantizer merges first.
+type OctreeMerge int
+
+const (
+	// OctreeMergeFewest merges the leaves of the node with the fewest
+	// pixels first, keeping the colors of large areas apart.
+	OctreeMergeFewest OctreeMerge = iota
+	// OctreeMergeDeepest merges the leaves of the deepest nodes first, and
+	// of those with the fewest pixels, keeping colors far apart separate.
+	// It is the classic strategy.
+	OctreeMergeDeepest
+)
+
+// octreeMaxLeaves bounds the number of leaves while the tree is built,
+// and so its memory, however many colors the image has.
+const octreeMaxLeaves = 1 << 12
+
+// OctreeQuantizer constructs a palette with a maximum of NumColor colors
+// by sorting the colors into a tree of cubes of RGB space, each split
+// into eight down to the depth of the tree, then merging the smallest
+// cubes into their parents until few enough remain. Each remaining cube
+// gives the average color of the pixels in it. The tree is kept small
+// however many colors the image has. The palette is usually less accurate
+// than MedianCutQuantizer's. For images with very many colors, such as
+// noise, it is about twice as fast; for others it takes about as long, as
+// mapping the pixels to the palette dominates.
+type OctreeQuantizer struct {
+	// NumColor is as for MedianCutQuantizer.
+	NumColor int
+	// Depth is the depth of the tree, from 1 to 8; zero means 8. A tree
+	// of depth d has at most 8^d leaves, so a depth under 3 limits the
+	// palette to fewer than 256 colors.
+	Depth int
+	// Merge is the order in which leaves are merged.
+	Merge OctreeMerge
+	// AlphaThreshold is as for MedianCutQuantizer.
+	AlphaThreshold uint16
+	// Dither says how to dither the pixels mapped to the palette.
+	Dither Dither
+}
+
+// Quantize sets dst.Palette as well as dst's pixels in r, from the pixels
+// of src starting at sp.
+func (q *OctreeQuantizer) Quantize(dst *image.Paletted, r image.Rectangle, src image.Image, sp image.Point) {
+	clip(dst, &r, src, &sp)
+	if r.Empty() {
+		return
+	}
+
+	depth := q.Depth
+	if depth <= 0 || depth > 8 {
+		depth = 8
+	}
+	colors := newColorSet(q.NumColor)
+	t := newOctree(depth, q.Merge)
+	transparent := readColors(r, src, sp, q.AlphaThreshold, func(c color.RGBA64, n int) {
+		colors.add(c)
+		t.add(c, n)
+	})
+	setPalette(dst, colors, q.NumColor, transparent, func(numColor int) color.Palette {
+		t.reduce(numColor)
+		return t.palette()
+	})
+
+	remap(dst, r, src, sp, q.AlphaThreshold, &q.Dither)
+}
+
+// octreeNode is a cube of RGB space. The sums and count of a leaf cover
+// the pixels added to it; those of other nodes are only set when their
+// children are about to be merged.
+type octreeNode struct {
+	// children index the nodes of the eighths of the cube, or are 0,
+	// which is the root and never a child.
+	children [8]int32
+	parent   int32
+	leaf     bool
+	level    uint8
+	r, g, b  uint64
+	n        int
+}
+
+// octree is an octree of colors, with its nodes kept in a slice.
+type octree struct {
+	nodes  []octreeNode
+	free   []int32 // Indexes of nodes no longer used.
+	leaves int
+	depth  int
+	merge  OctreeMerge
+}
+
+func newOctree(depth int, merge OctreeMerge) *octree {
+	return &octree{
+		nodes: []octreeNode{{leaf: depth == 0}},
+		depth: depth,
+		merge: merge,
+	}
+}
+
+// add adds n pixels of color c.
+func (t *octree) add(c color.RGBA64, n int) {
+	i := int32(0)
+	for level := 0; ; level++ {
+		node := &t.nodes[i]
+		if node.leaf {
+			node.r += uint64(c.R) * uint64(n)
+			node.g += uint64(c.G) * uint64(n)
+			node.b += uint64(c.B) * uint64(n)
+			node.n += n
+			break
+		}
+		shift := uint(15 - level)
+		k := (c.R>>shift&1)<<2 | (c.G>>shift&1)<<1 | c.B>>shift&1
+		child := node.children[k]
+		if child == 0 {
+			child = t.newNode(i, level+1, level+1 == t.depth)
+			t.nodes[i].children[k] = child
+		}
+		i = child
+	}
+	if t.leaves > octreeMaxLeaves {
+		t.reduce(octreeMaxLeaves / 2)
+	}
+}
+
+// newNode returns the index of a new child of node parent at level.
+func (t *octree) newNode(parent int32, level int, leaf bool) int32 {
+	if leaf {
+		t.leaves++
+	}
+	node := octreeNode{parent: parent, leaf: leaf, level: uint8(level)}
+	if n := len(t.free); n > 0 {
+		i := t.free[n-1]
+		t.free = t.free[:n-1]
+		t.nodes[i] = node
+		return i
+	}
+	t.nodes = append(t.nodes, node)
+	return int32(len(t.nodes) - 1)
+}
+
+// reduce merges leaves into their parents until there are at most
+// numColor leaves.
+func (t *octree) reduce(numColor int) {
+	numColor = max(numColor, 1)
+	if t.leaves <= numColor {
+		return
+	}
+	// Only nodes whose children are all leaves are merged, so that merging
+	// never skips a level. Merging some makes their parents candidates in
+	// the next round; the tree is scanned for them only once.
+	var candidates []int32
+	for i := range t.nodes {
+		if t.isCandidate(int32(i)) {
+			candidates = append(candidates, int32(i))
+		}
+	}
+	for t.leaves > numColor && len(candidates) > 0 {
+		sort.Sort(octreeCandidates{t, candidates})
+		// Skip merges that would leave fewer than numColor leaves, unless
+		// there are no others. The skipped candidates stay candidates.
+		var next []int32
+		merged := false
+		for k, i := range candidates {
+			excess := t.leaves - numColor
+			if excess <= 0 {
+				next = append(next, candidates[k:]...)
+				break
+			}
+			if t.numChildren(i)-1 > excess {
+				next = append(next, i)
+				continue
+			}
+			next = t.mergeCandidate(i, next)
+			merged = true
+		}
+		if !merged {
+			// All of them are in next, in order.
+			next = t.mergeCandidate(candidates[0], next[1:])
+		}
+		candidates = next
+	}
+}
+
+// mergeCandidate merges the children of node i and returns candidates with its
+// parent added if that has become a candidate.
+func (t *octree) mergeCandidate(i int32, candidates []int32) []int32 {
+	t.mergeChildren(i)
+	if p := t.nodes[i].parent; i != 0 && t.isCandidate(p) {
+		candidates = append(candidates, p)
+	}
+	return candidates
+}
+
+// isCandidate reports whether node i can have its children merged: it has
+// children and they are all leaves. If so it sets the node's count to
+// theirs.
+func (t *octree) isCandidate(i int32) bool {
+	node := &t.nodes[i]
+	if node.leaf {
+		return false
+	}
+	n := 0
+	for _, c := range node.children {
+		if c != 0 {
+			if !t.nodes[c].leaf {
+				return false
+			}
+			n += t.nodes[c].n
+		}
+	}
+	node.n = n
+	return true
+}
+
+// octreeCandidates sorts the indexes of nodes in the order they are
+// merged.
+type octreeCandidates struct {
+	t *octree
+	i []int32
+}
+
+func (c octreeCandidates) Len() int      { return len(c.i) }
+func (c octreeCandidates) Swap(i, j int) { c.i[i], c.i[j] = c.i[j], c.i[i] }
+func (c octreeCandidates) Less(i, j int) bool {
+	a, b := &c.t.nodes[c.i[i]], &c.t.nodes[c.i[j]]
+	if c.t.merge == OctreeMergeDeepest && a.level != b.level {
+		return a.level > b.level
+	}
+	if a.n != b.n {
+		return a.n < b.n
+	}
+	return c.i[i] < c.i[j]
+}
+
+// numChildren returns the number of children of node i.
+func (t *octree) numChildren(i int32) int {
+	n := 0
+	for _, c := range t.nodes[i].children {
+		if c != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// mergeChildren makes node i a leaf in place of its children.
+func (t *octree) mergeChildren(i int32) {
+	node := &t.nodes[i]
+	node.r, node.g, node.b, node.n = 0, 0, 0, 0
+	for k, c := range node.children {
+		if c != 0 {
+			child := &t.nodes[c]
+			node.r += child.r
+			node.g += child.g
+			node.b += child.b
+			node.n += child.n
+			t.leaves--
+			// Unused nodes are leaves, so they are never merged.
+			*child = octreeNode{leaf: true}
+			t.free = append(t.free, c)
+			node.children[k] = 0
+		}
+	}
+	node.leaf = true
+	t.leaves++
+}
+
+// palette returns the average colors of the leaves.
+func (t *octree) palette() color.Palette {
+	p := make(color.Palette, 0, t.leaves)
+	var walk func(i int32)
+	walk = func(i int32) {
+		node := &t.nodes[i]
+		if node.leaf {
+			if node.n > 0 {
+				n := uint64(node.n)
+				p = append(p, color.RGBA64{uint16(node.r / n), uint16(node.g / n), uint16(node.b / n), 0xffff})
+			}
+			return
+		}
+		for _, c := range node.children {
+			if c != 0 {
+				walk(c)
+			}
+		}
+	}
+	walk(0)
+	return p
+}
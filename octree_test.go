@@ -0,0 +1,120 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestOctreeQuantizer(t *testing.T) {
+	src := frame1080p().SubImage(image.Rect(400, 200, 1000, 800)).(*image.RGBA)
+	for _, merge := range []OctreeMerge{OctreeMergeFewest, OctreeMergeDeepest} {
+		for _, depth := range []int{0, 2, 4, 6} {
+			for _, numColor := range []int{2, 16, 256} {
+				q := &OctreeQuantizer{NumColor: numColor, Depth: depth, Merge: merge}
+				dst := image.NewPaletted(src.Bounds(), nil)
+				q.Quantize(dst, src.Bounds(), src, src.Bounds().Min)
+				if n := len(dst.Palette); n == 0 || n > numColor {
+					t.Errorf("merge=%d depth=%d NumColor=%d: got %d colors", merge, depth, numColor, n)
+				}
+				if depth == 2 && len(dst.Palette) > 64 {
+					t.Errorf("merge=%d depth=2: got %d colors, want at most 64", merge, len(dst.Palette))
+				}
+				if e := quantizeError(dst, src); numColor == 256 && depth != 2 && e > 8 {
+					t.Errorf("merge=%d depth=%d NumColor=%d: error %.2f", merge, depth, numColor, e)
+				}
+			}
+		}
+	}
+}
+
+func TestOctreeQuantizerError(t *testing.T) {
+	// The octree trades some quality for speed, but stays within half
+	// again of median cut's error on photographs.
+	for _, filename := range []string{"testdata/teapool.png", "testdata/video-001.png"} {
+		src, err := readRGBA(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, merge := range []OctreeMerge{OctreeMergeFewest, OctreeMergeDeepest} {
+			for _, numColor := range []int{64, 256} {
+				got := image.NewPaletted(src.Bounds(), nil)
+				(&OctreeQuantizer{NumColor: numColor, Merge: merge}).Quantize(got, src.Bounds(), src, src.Bounds().Min)
+				want := image.NewPaletted(src.Bounds(), nil)
+				(&MedianCutQuantizer{NumColor: numColor}).Quantize(want, src.Bounds(), src, src.Bounds().Min)
+				if got, want := quantizeError(got, src), quantizeError(want, src); got > 1.6*want {
+					t.Errorf("%s merge=%d NumColor %d: error %.2f, more than 1.6 times median cut's %.2f",
+						filename, merge, numColor, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestOctreeQuantizerFewColors(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	colors := []color.RGBA{{0xff, 0, 0, 0xff}, {0, 0xff, 0, 0xff}, {0, 0, 0xff, 0xff}}
+	for i := range src.Pix[:len(src.Pix)/4] {
+		c := colors[i%len(colors)]
+		src.Pix[4*i], src.Pix[4*i+1], src.Pix[4*i+2], src.Pix[4*i+3] = c.R, c.G, c.B, c.A
+	}
+	dst := image.NewPaletted(src.Bounds(), nil)
+	(&OctreeQuantizer{NumColor: 4}).Quantize(dst, src.Bounds(), src, image.ZP)
+	if len(dst.Palette) != 3 {
+		t.Fatalf("got %d colors, want 3", len(dst.Palette))
+	}
+	for i := range dst.Pix {
+		got, want := dst.Palette[dst.Pix[i]], colors[i%len(colors)]
+		if color.RGBA64Model.Convert(got) != color.RGBA64Model.Convert(want) {
+			t.Fatalf("pixel %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func BenchmarkOctreeQuantize1080p(b *testing.B) {
+	benchmarkQuantizer(b, &OctreeQuantizer{NumColor: 256}, frame1080p())
+}
+
+func BenchmarkOctreeQuantize1080pDeepest(b *testing.B) {
+	benchmarkQuantizer(b, &OctreeQuantizer{NumColor: 256, Merge: OctreeMergeDeepest}, frame1080p())
+}
+
+func BenchmarkOctreeQuantizeNoise1080p(b *testing.B) {
+	benchmarkQuantizer(b, &OctreeQuantizer{NumColor: 256}, noise1080p())
+}
+
+// readRGBA reads the image in filename into an RGBA image.
+func readRGBA(filename string) (*image.RGBA, error) {
+	m, err := readImg(filename)
+	if err != nil {
+		return nil, err
+	}
+	src := image.NewRGBA(m.Bounds())
+	draw.Draw(src, src.Bounds(), m, m.Bounds().Min, draw.Src)
+	return src, nil
+}
+
+// The benchmarks below compare the octree with median cut on a photograph.
+// BenchmarkQuantize1080p and BenchmarkQuantizeNoise1080p time median cut on
+// the frames above.
+
+func BenchmarkOctreeQuantizePhoto(b *testing.B) {
+	src, err := readRGBA("testdata/video-001.png")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkQuantizer(b, &OctreeQuantizer{NumColor: 256}, src)
+}
+
+func BenchmarkMedianCutQuantizePhoto(b *testing.B) {
+	src, err := readRGBA("testdata/video-001.png")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkQuantizer(b, &MedianCutQuantizer{NumColor: 256}, src)
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+)
+
+// DecodeAllParallel is like DecodeAll, but decompresses the frames on up
+// to workers goroutines at once. It reads all of r into memory, scans it
+// to find each frame's compressed data and then decodes the frames
+// independently. If workers is zero or negative, runtime.GOMAXPROCS(0) is
+// used. If the file is malformed, it is decoded again by DecodeAll, so
+// that the error is the one DecodeAll returns.
+func DecodeAllParallel(r io.Reader, workers int) (*gif.GIF, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	x, err := NewIndex(bytes.NewReader(data))
+	if err != nil {
+		return DecodeAll(bytes.NewReader(data))
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	images := make([]*image.Paletted, len(x.Frames))
+	errs := make([]error, len(x.Frames))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(x.Frames)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				images[i], errs[i] = x.Frame(i)
+			}
+		}()
+	}
+	for i := range x.Frames {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return DecodeAll(bytes.NewReader(data))
+		}
+	}
+	delay := make([]int, len(x.Frames))
+	for i, f := range x.Frames {
+		if f.GraphicControl != nil {
+			delay[i] = f.GraphicControl.Delay
+		}
+	}
+	return &gif.GIF{
+		Image:     images,
+		LoopCount: x.LoopCount,
+		Delay:     delay,
+	}, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAllParallel(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/*.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{0, 1, 3} {
+			got, err := DecodeAllParallel(bytes.NewReader(b), workers)
+			if err != nil {
+				t.Errorf("%s: %v", filename, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %d workers: result differs from DecodeAll", filename, workers)
+			}
+		}
+	}
+
+	// Errors are the same too.
+	for _, b := range [][]byte{testGIF[:len(testGIF)-3], testGIF[:len(testGIF)-1]} {
+		_, want := DecodeAll(bytes.NewReader(b))
+		_, got := DecodeAllParallel(bytes.NewReader(b), 2)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got error %v, want %v", got, want)
+		}
+	}
+}
+
+func BenchmarkDecodeAllParallel(b *testing.B) {
+	b.StopTimer()
+	data, err := ioutil.ReadFile("testdata/scape.gif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAllParallel(bytes.NewReader(data), 0)
+	}
+}
+
+// recording returns a GIF of 60 640×360 frames, each covering the whole
+// screen, like a screen recording.
+func recording(b *testing.B) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < 60; i++ {
+		m := image.NewPaletted(image.Rect(0, 0, 640, 360), palette.Plan9)
+		for y := 0; y < 360; y++ {
+			for x := 0; x < 640; x++ {
+				m.Pix[y*m.Stride+x] = uint8((x+2*y+5*i)/4 ^ x*y>>9)
+			}
+		}
+		g.Image = append(g.Image, m)
+		g.Delay = append(g.Delay, 4)
+	}
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, g); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkDecodeAllRecording and BenchmarkDecodeAllParallelRecording
+// compare sequential and parallel decoding of a long animation.
+
+func BenchmarkDecodeAllRecording(b *testing.B) {
+	data := recording(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAll(bytes.NewReader(data))
+	}
+}
+
+func BenchmarkDecodeAllParallelRecording(b *testing.B) {
+	data := recording(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAllParallel(bytes.NewReader(data), 0)
+	}
+}
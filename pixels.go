@@ -0,0 +1,350 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// A rowReader converts the len(row) pixels of an image starting at (x, y)
+// to alpha-premultiplied 16-bit colors, as their RGBA methods give them.
+type rowReader func(row []color.RGBA64, x, y int)
+
+// newRowReader returns a rowReader for m. The pixel data of the common
+// image types is read directly; other images go through At.
+func newRowReader(m image.Image) rowReader {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return func(row []color.RGBA64, x, y int) {
+			i := m.PixOffset(x, y)
+			pix := m.Pix[i : i+4*len(row)]
+			for i := range row {
+				p := pix[4*i : 4*i+4 : 4*i+4]
+				row[i] = color.RGBA64{
+					uint16(p[0]) * 0x101,
+					uint16(p[1]) * 0x101,
+					uint16(p[2]) * 0x101,
+					uint16(p[3]) * 0x101,
+				}
+			}
+		}
+
+	case *image.NRGBA:
+		return func(row []color.RGBA64, x, y int) {
+			pix := m.Pix[m.PixOffset(x, y):]
+			for i := range row {
+				p := pix[4*i : 4*i+4]
+				r, g, b, a := color.NRGBA{p[0], p[1], p[2], p[3]}.RGBA()
+				row[i] = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+			}
+		}
+
+	case *image.YCbCr:
+		return func(row []color.RGBA64, x, y int) {
+			for i := range row {
+				yi, ci := m.YOffset(x+i, y), m.COffset(x+i, y)
+				r, g, b, _ := color.YCbCr{m.Y[yi], m.Cb[ci], m.Cr[ci]}.RGBA()
+				row[i] = color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff}
+			}
+		}
+
+	case *image.Paletted:
+		palette := make([]color.RGBA64, len(m.Palette))
+		for i, c := range m.Palette {
+			r, g, b, a := c.RGBA()
+			palette[i] = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+		}
+		return func(row []color.RGBA64, x, y int) {
+			pix := m.Pix[m.PixOffset(x, y):]
+			for i := range row {
+				row[i] = palette[pix[i]]
+			}
+		}
+	}
+	return func(row []color.RGBA64, x, y int) {
+		for i := range row {
+			r, g, b, a := m.At(x+i, y).RGBA()
+			row[i] = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+		}
+	}
+}
+
+// paletteIndexer finds the palette color nearest to a color, giving the
+// same index as color.Palette.Index: the lowest index of those at the least
+// distance. It searches a k-d tree of the palette colors and caches the
+// results.
+type paletteIndexer struct {
+	// nodes is the k-d tree: the node of a range of it is in the middle,
+	// with those in the first half having values along its axis no more
+	// than its own and those in the second half no less.
+	nodes []kdNode
+	// cache holds recent results, by a hash of the color looked up.
+	cache [1 << 12]struct {
+		c     color.RGBA64
+		index int32
+		ok    bool
+	}
+	// The search state.
+	c        [4]uint16
+	best     int32
+	bestDist uint32
+}
+
+// A kdNode is a palette color with its index.
+type kdNode struct {
+	c     [4]uint16
+	index int32
+	axis  uint8
+}
+
+// kdNodes sorts nodes along an axis.
+type kdNodes struct {
+	nodes []kdNode
+	axis  int
+}
+
+func (s kdNodes) Len() int           { return len(s.nodes) }
+func (s kdNodes) Less(i, j int) bool { return s.nodes[i].c[s.axis] < s.nodes[j].c[s.axis] }
+func (s kdNodes) Swap(i, j int)      { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+
+func newPaletteIndexer(p color.Palette) *paletteIndexer {
+	x := &paletteIndexer{nodes: make([]kdNode, len(p))}
+	for i, c := range p {
+		r, g, b, a := c.RGBA()
+		x.nodes[i] = kdNode{c: [4]uint16{uint16(r), uint16(g), uint16(b), uint16(a)}, index: int32(i)}
+	}
+	buildKD(x.nodes)
+	return x
+}
+
+// buildKD arranges nodes into a k-d tree, splitting each range along the
+// axis with the widest spread of values.
+func buildKD(nodes []kdNode) {
+	if len(nodes) <= 1 {
+		return
+	}
+	lo, hi := nodes[0].c, nodes[0].c
+	for _, n := range nodes[1:] {
+		for k, v := range n.c {
+			if v < lo[k] {
+				lo[k] = v
+			}
+			if v > hi[k] {
+				hi[k] = v
+			}
+		}
+	}
+	axis := 0
+	for k := 1; k < len(lo); k++ {
+		if hi[k]-lo[k] > hi[axis]-lo[axis] {
+			axis = k
+		}
+	}
+	sort.Sort(kdNodes{nodes, axis})
+	m := len(nodes) / 2
+	nodes[m].axis = uint8(axis)
+	buildKD(nodes[:m])
+	buildKD(nodes[m+1:])
+}
+
+// index returns the index of the palette color nearest to c.
+func (x *paletteIndexer) index(c color.RGBA64) int {
+	h := (uint32(c.R)*0x9e3779b1 ^ uint32(c.G)*0x85ebca6b ^ uint32(c.B)*0xc2b2ae35 ^ uint32(c.A)) >> 20
+	e := &x.cache[h]
+	if e.ok && e.c == c {
+		return int(e.index)
+	}
+	x.c = [4]uint16{c.R, c.G, c.B, c.A}
+	x.best, x.bestDist = 0, 1<<32-1
+	x.search(x.nodes)
+	e.c, e.index, e.ok = c, x.best, true
+	return int(x.best)
+}
+
+// search looks for a color nearer to x.c than the best so far in the k-d
+// tree nodes.
+func (x *paletteIndexer) search(nodes []kdNode) {
+	if len(nodes) == 0 {
+		return
+	}
+	m := len(nodes) / 2
+	n := &nodes[m]
+	dist := sqDiff(x.c[0], n.c[0]) + sqDiff(x.c[1], n.c[1]) + sqDiff(x.c[2], n.c[2]) + sqDiff(x.c[3], n.c[3])
+	if dist < x.bestDist || (dist == x.bestDist && n.index < x.best) {
+		x.best, x.bestDist = n.index, dist
+	}
+	if len(nodes) == 1 {
+		return
+	}
+	near, far := nodes[:m], nodes[m+1:]
+	if x.c[n.axis] >= n.c[n.axis] {
+		near, far = far, near
+	}
+	x.search(near)
+	// The colors on the far side are at least as far away along the axis
+	// as the splitting one, and each component adds to the distance. Ties
+	// must be searched too, for a lower index.
+	if sqDiff(x.c[n.axis], n.c[n.axis]) <= x.bestDist {
+		x.search(far)
+	}
+}
+
+// sqDiff returns the squared difference of x and y, shifted right by 2 so
+// that a sum of four of them fits in a uint32, as color.Palette.Index
+// computes it.
+func sqDiff(x, y uint16) uint32 {
+	d := uint32(x) - uint32(y)
+	return (d * d) >> 2
+}
+
+// visibleColor returns c as quantization sees it given an alpha threshold,
+// and whether it is visible. A zero threshold leaves colors as they are.
+// Otherwise colors with an alpha below it are transparent and the others
+// are made opaque by undoing their alpha premultiplication.
+func visibleColor(c color.RGBA64, threshold uint16) (color.RGBA64, bool) {
+	switch {
+	case threshold == 0 || c.A == 0xffff:
+		return c, true
+	case c.A < threshold:
+		return c, false
+	}
+	a := uint32(c.A)
+	return color.RGBA64{
+		uint16(uint32(c.R) * 0xffff / a),
+		uint16(uint32(c.G) * 0xffff / a),
+		uint16(uint32(c.B) * 0xffff / a),
+		0xffff,
+	}, true
+}
+
+// remap sets the pixels of dst in r to the indexes of the palette colors
+// nearest to the pixels of src from sp, dithered as d says. With a
+// non-zero alpha threshold, as for visibleColor, the invisible pixels get
+// the last palette entry if it is transparent, and the visible ones are
+// matched against the others.
+func remap(dst *image.Paletted, r image.Rectangle, src image.Image, sp image.Point, threshold uint16, d *Dither) {
+	m := newPixelMapper(dst.Palette, threshold)
+	read := newRowReader(src)
+	if d.Kernel != nil {
+		m.diffuse(dst, r, read, sp, d)
+		return
+	}
+	if d.Ordered != nil && d.Ordered.valid() {
+		m.order(dst, r, read, sp, d)
+		return
+	}
+	// Pixels the same as the one before or above them take its index.
+	row, above := make([]color.RGBA64, r.Dx()), make([]color.RGBA64, r.Dx())
+	var abovePix []uint8
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		read(row, sp.X, sp.Y+y-r.Min.Y)
+		pix := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		for i, c := range row {
+			if i > 0 && c == row[i-1] {
+				pix[i] = pix[i-1]
+				continue
+			}
+			if abovePix != nil && c == above[i] {
+				pix[i] = abovePix[i]
+				continue
+			}
+			if c, ok := visibleColor(c, m.threshold); ok {
+				pix[i] = uint8(m.x.index(c))
+			} else {
+				pix[i] = m.transparent
+			}
+		}
+		row, above, abovePix = above, row, pix
+	}
+}
+
+// A pixelMapper maps pixels to the indexes of a palette.
+type pixelMapper struct {
+	x *paletteIndexer
+	// palette holds the colors matched against, which are those of the
+	// palette but for a reserved transparent entry.
+	palette   []color.RGBA64
+	threshold uint16
+	// transparent is the index for invisible pixels.
+	transparent uint8
+}
+
+func newPixelMapper(p color.Palette, threshold uint16) *pixelMapper {
+	m := &pixelMapper{threshold: threshold}
+	if n := len(p); threshold != 0 && n > 0 {
+		if _, _, _, a := p[n-1].RGBA(); a == 0 {
+			p, m.transparent = p[:n-1], uint8(n-1)
+		}
+	}
+	m.x = newPaletteIndexer(p)
+	m.palette = make([]color.RGBA64, len(p))
+	for i, c := range p {
+		r, g, b, a := c.RGBA()
+		m.palette[i] = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+	}
+	return m
+}
+
+// readColors calls f with each run of n pixels of the same visible color c
+// in r, read from src at sp, and reports whether any of the pixels are
+// invisible. Colors are as visibleColor makes them with threshold.
+func readColors(r image.Rectangle, src image.Image, sp image.Point, threshold uint16, f func(c color.RGBA64, n int)) (transparent bool) {
+	read := newRowReader(src)
+	row := make([]color.RGBA64, r.Dx())
+	for y := 0; y < r.Dy(); y++ {
+		read(row, sp.X, sp.Y+y)
+		// Count runs of the same color at once.
+		run := 0
+		for i, c := range row {
+			run++
+			if i+1 < len(row) && row[i+1] == c {
+				continue
+			}
+			if c, ok := visibleColor(c, threshold); ok {
+				f(c, run)
+			} else {
+				transparent = true
+			}
+			run = 0
+		}
+	}
+	return transparent
+}
+
+// paletteSize returns the number of colors a quantizer's NumColor asks
+// for: 256 if it is not positive.
+func paletteSize(numColor int) int {
+	if numColor <= 0 {
+		return 256
+	}
+	return numColor
+}
+
+// setPalette sets dst.Palette to at most numColor colors, with a fully
+// transparent last entry if transparent and there is room for it besides
+// a visible color. If the colors in s fit they are used as they are;
+// otherwise quantize is called to choose as many as are left.
+func setPalette(dst *image.Paletted, s *colorSet, numColor int, transparent bool, quantize func(numColor int) color.Palette) {
+	numColor = paletteSize(numColor)
+	// A palette of one color keeps it for the visible pixels, unless
+	// there are none.
+	reserve := transparent && (numColor >= 2 || len(s.order) == 0)
+	if reserve {
+		numColor--
+	}
+	if !s.full && len(s.colors) <= numColor {
+		// No need to quantize since the total number of colors
+		// fits within the palette.
+		dst.Palette = make(color.Palette, 0, len(s.order)+1)
+		dst.Palette = append(dst.Palette, s.order...)
+	} else {
+		dst.Palette = quantize(numColor)
+	}
+	if reserve {
+		dst.Palette = append(dst.Palette, color.RGBA{})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestPaletteIndexer(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// Coarse values make for many colors at equal distances, which must
+	// resolve to the lowest index as they do in color.Palette.Index.
+	coarse := func() uint8 { return uint8(rnd.Intn(4) * 85) }
+	fine := func() uint8 { return uint8(rnd.Intn(256)) }
+	for _, size := range []int{0, 1, 2, 3, 16, 100, 256} {
+		for _, value := range []func() uint8{coarse, fine} {
+			p := make(color.Palette, size)
+			for i := range p {
+				a := uint8(0xff)
+				if rnd.Intn(4) == 0 {
+					a = value()
+				}
+				p[i] = color.NRGBA{value(), value(), value(), a}
+			}
+			if size > 4 {
+				// Duplicate entries.
+				p[size-1] = p[1]
+			}
+			x := newPaletteIndexer(p)
+			for i := 0; i < 2000; i++ {
+				var c color.RGBA64
+				if i < size {
+					r, g, b, a := p[i].RGBA()
+					c = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+				} else {
+					r, g, b, a := color.NRGBA{value(), value(), value(), value()}.RGBA()
+					c = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+				}
+				// Look up twice, the second time from the cache.
+				for k := 0; k < 2; k++ {
+					if got, want := x.index(c), p.Index(c); got != want {
+						t.Fatalf("size %d: %v: got index %d, want %d", size, c, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// benchmarkColors returns random colors and a palette of 256 of them.
+func benchmarkColors() ([]color.RGBA64, color.Palette) {
+	rnd := rand.New(rand.NewSource(1))
+	colors := make([]color.RGBA64, 1<<16)
+	for i := range colors {
+		colors[i] = color.RGBA64{uint16(rnd.Intn(1 << 16)), uint16(rnd.Intn(1 << 16)), uint16(rnd.Intn(1 << 16)), 0xffff}
+	}
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = colors[i]
+	}
+	return colors, p
+}
+
+func BenchmarkPaletteIndexer(b *testing.B) {
+	colors, p := benchmarkColors()
+	x := newPaletteIndexer(p)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.index(colors[i%len(colors)])
+	}
+}
+
+// BenchmarkPaletteIndex looks up the same colors as BenchmarkPaletteIndexer
+// with color.Palette.Index, for comparison.
+func BenchmarkPaletteIndex(b *testing.B) {
+	colors, p := benchmarkColors()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Index(colors[i%len(colors)])
+	}
+}
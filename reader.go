@@ -9,6 +9,7 @@ package gogif
 
 import (
 	"bufio"
+	"bytes"
 	"compress/lzw"
 	"errors"
 	"fmt"
@@ -16,6 +17,8 @@ import (
 	"image/color"
 	"image/gif"
 	"io"
+	"io/ioutil"
+	"time"
 )
 
 var (
@@ -24,6 +27,10 @@ var (
 	errBadPixel  = errors.New("gif: invalid pixel value")
 )
 
+// ErrLimitExceeded is returned, wrapped with the limit concerned, when
+// decoding would exceed one of the limits set in DecodeOptions.
+var ErrLimitExceeded = errors.New("gif: decode limit exceeded")
+
 // If the io.Reader does not also have ReadByte, then decode will introduce its own buffering.
 type reader interface {
 	io.Reader
@@ -61,7 +68,10 @@ const (
 
 // decoder is the type used to decode a GIF file.
 type decoder struct {
-	r reader
+	r *countingReader
+
+	// Where decoding is, for errors.
+	block string
 
 	// From header.
 	vers            string
@@ -88,60 +98,137 @@ type decoder struct {
 	globalColorMap color.Palette
 
 	// Used when decoding.
-	delay []int
-	image []*image.Paletted
-	tmp   [1024]byte // must be at least 768 so we can read color map
+	delay       []int
+	image       []*image.Paletted
+	transparent []color.Color
+	tmp         [1024]byte // must be at least 768 so we can read color map
+
+	// From DecodeOptions.
+	lenient        bool
+	maxFramePixels int
+	maxFrames      int
+	maxBytes       int64
+	maxDuration    time.Duration
+
+	// From comment, plain text and application extensions.
+	comments     []Comment
+	plainTexts   []PlainText
+	applications []Application
+
+	// Extensions the decoder does not interpret, if kept.
+	keepUnknown bool
+	unknown     []RawExtension
+
+	// Progress callbacks.
+	onPass func(frame, pass int, m *image.Paletted)
+	onRows func(frame, rows int, m *image.Paletted)
+
+	// Set by DecodeSummary, which records only the frame bounds.
+	summaryOnly bool
+	bounds      []image.Rectangle
+
+	// Running totals checked against the limits.
+	decodedBytes int64
+	totalDelay   int
+
+	// trailer is set once the trailer has been read. The bytes after it
+	// are counted in trailing if countTrailing is set.
+	trailer       bool
+	countTrailing bool
+	trailing      int64
+
+	// Problems worked around by lenient decoding.
+	warnings []error
+
+	// Reused when decoding.
+	buffers *Buffers
+	lzwd    *lzwDecoder
+}
+
+// DecodeError records where in a GIF file decoding failed, or, as one of
+// GIF.Warnings, where lenient decoding worked around a problem.
+//
+// DecodeAllOptions, DecodeSummary, NewIndex and StreamReader return their
+// errors as a *DecodeError, whose Error string adds the position to that
+// of the underlying error; use errors.Is or errors.As to examine them.
+// Decode, DecodeAll and DecodeConfig, like image/gif, return the
+// underlying error itself, so that callers comparing it with == or by its
+// string are unaffected.
+type DecodeError struct {
+	Offset int64  // Byte offset in the input at which the problem was found.
+	Frame  int    // Index of the frame being decoded, or about to be.
+	Block  string // Kind of block being read, such as "image data".
+	Err    error  // The underlying error.
 }
 
-// blockReader parses the block structure of GIF image data, which
-// comprises (n, (n bytes)) blocks, with 1 <= n <= 255.  It is the
-// reader given to the LZW decoder, which is thus immune to the
-// blocking.  After the LZW decoder completes, there will be a 0-byte
-// block remaining (0, ()), which is consumed when checking that the
-// blockReader is exhausted.
-type blockReader struct {
-	r     reader
-	slice []byte
-	err   error
-	tmp   [256]byte
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v (frame %d, %s at offset %d)", e.Err, e.Frame, e.Block, e.Offset)
 }
 
-func (b *blockReader) Read(p []byte) (int, error) {
-	if b.err != nil {
-		return 0, b.err
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// unwrapDecodeError returns the error underlying err, if it is a
+// *DecodeError, for the functions that return errors as image/gif does.
+func unwrapDecodeError(err error) error {
+	if e, ok := err.(*DecodeError); ok {
+		return e.Err
 	}
-	if len(p) == 0 {
-		return 0, nil
+	return err
+}
+
+// wrap returns err as a *DecodeError recording the current position.
+func (d *decoder) wrap(err error) error {
+	if _, ok := err.(*DecodeError); ok {
+		return err
 	}
-	if len(b.slice) == 0 {
-		var blockLen uint8
-		blockLen, b.err = b.r.ReadByte()
-		if b.err != nil {
-			return 0, b.err
-		}
-		if blockLen == 0 {
-			b.err = io.EOF
-			return 0, b.err
-		}
-		b.slice = b.tmp[0:blockLen]
-		if _, b.err = io.ReadFull(b.r, b.slice); b.err != nil {
-			return 0, b.err
-		}
+	return &DecodeError{
+		Offset: d.r.n,
+		Frame:  len(d.delay),
+		Block:  d.block,
+		Err:    err,
 	}
-	n := copy(p, b.slice)
-	b.slice = b.slice[n:]
-	return n, nil
 }
 
-// decode reads a GIF image from r and stores the result in d.
-func (d *decoder) decode(r io.Reader, configOnly bool) error {
-	// Add buffering if r does not provide ReadByte.
+// setReader sets the reader to decode from, adding buffering if r does
+// not provide ReadByte.
+func (d *decoder) setReader(r io.Reader) {
 	if rr, ok := r.(reader); ok {
-		d.r = rr
+		d.r = &countingReader{r: rr}
+	} else if d.buffers != nil {
+		if d.buffers.br == nil {
+			d.buffers.br = bufio.NewReader(r)
+		} else {
+			d.buffers.br.Reset(r)
+		}
+		d.r = &countingReader{r: d.buffers.br}
 	} else {
-		d.r = bufio.NewReader(r)
+		d.r = &countingReader{r: bufio.NewReader(r)}
 	}
+}
 
+// decode reads a GIF image from r and stores the result in d. Errors are
+// returned as a *DecodeError.
+func (d *decoder) decode(r io.Reader, configOnly bool) error {
+	d.setReader(r)
+	if err := d.readFile(configOnly); err != nil {
+		return d.wrap(err)
+	}
+	if d.trailer && d.countTrailing {
+		d.block = "trailing data"
+		n, err := io.Copy(ioutil.Discard, d.r)
+		d.trailing = n
+		if err != nil {
+			return d.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (d *decoder) readFile(configOnly bool) error {
+	d.block = "header"
 	err := d.readHeaderAndScreenDescriptor()
 	if err != nil {
 		return err
@@ -151,102 +238,549 @@ func (d *decoder) decode(r io.Reader, configOnly bool) error {
 	}
 
 	if d.headerFields&fColorMapFollows != 0 {
+		d.block = "global color table"
 		if d.globalColorMap, err = d.readColorMap(); err != nil {
 			return err
 		}
 	}
 
+	err = d.readBlocks()
+	if err != nil && d.lenient && len(d.image) > 0 && !errors.Is(err, ErrLimitExceeded) {
+		// Keep the frames decoded so far.
+		d.warnings = append(d.warnings, d.wrap(err))
+		return nil
+	}
+	return err
+}
+
+// readBlocks reads the blocks following the logical screen descriptor up
+// to and including the trailer.
+func (d *decoder) readBlocks() error {
+	junk := 0
 	for {
+		d.block = "block introducer"
 		c, err := d.r.ReadByte()
 		if err != nil {
 			return err
 		}
+		if junk > 0 && (c == sExtension || c == sImageDescriptor || c == sTrailer) {
+			d.warn("gif: skipped %d bytes of unknown block data", junk)
+			junk = 0
+		}
 		switch c {
 		case sExtension:
+			d.block = "extension"
 			if err = d.readExtension(); err != nil {
 				return err
 			}
 
 		case sImageDescriptor:
-			m, err := d.newImageFromDescriptor()
-			if err != nil {
+			d.block = "image descriptor"
+			if err = d.readImage(); err != nil {
 				return err
 			}
-			if d.imageFields&fColorMapFollows != 0 {
-				m.Palette, err = d.readColorMap()
+
+		case sTrailer:
+			if len(d.delay) == 0 {
+				if !d.lenient {
+					return io.ErrUnexpectedEOF
+				}
+				d.warn("gif: no image data; substituted a blank frame")
+				m, err := d.blankImage()
 				if err != nil {
 					return err
 				}
-			} else {
-				m.Palette = d.globalColorMap
+				d.appendFrame(m, nil)
 			}
-			if d.hasTransparentIndex && int(d.transparentIndex) < len(m.Palette) {
-				m.Palette[d.transparentIndex] = color.RGBA{}
+			d.trailer = true
+			return nil
+
+		default:
+			if !d.lenient {
+				return fmt.Errorf("gif: unknown block type: 0x%.2x", c)
 			}
-			litWidth, err := d.r.ReadByte()
-			if err != nil {
+			junk++
+		}
+	}
+}
+
+// readImage reads an image descriptor, its optional local color table and
+// its image data, and appends the resulting frame to d.image.
+func (d *decoder) readImage() error {
+	bounds, err := d.readImageDescriptor()
+	if err != nil {
+		return err
+	}
+	var p color.Palette
+	if d.imageFields&fColorMapFollows != 0 {
+		d.block = "local color table"
+		p, err = d.readColorMap()
+		if err != nil {
+			return err
+		}
+	} else {
+		p = d.globalColorMap
+	}
+	if d.summaryOnly {
+		return d.skipImageData(bounds)
+	}
+	// Only lenient decoding gets frames that are not within the screen.
+	// Only the part on the screen is kept, so only that is allocated and
+	// counted against the limits.
+	visible := bounds
+	if screen := image.Rect(0, 0, d.width, d.height); !bounds.In(screen) {
+		visible = bounds.Intersect(screen)
+		d.warn("gif: frame bounds %v clipped to %v", bounds, visible)
+	}
+	if visible != bounds && visible.Empty() {
+		// Nothing is left to show.
+		d.resetGraphicControl()
+		if _, err := d.r.ReadByte(); err != nil { // LZW Minimum Code Size.
+			return err
+		}
+		return (&subBlockReader{r: d.r}).skip()
+	}
+	if err := d.checkLimits(visible); err != nil {
+		return err
+	}
+	// The palette may be the global color map, shared with other frames,
+	// so make the transparent entry in a copy. The original color is kept
+	// for the caller.
+	var transparent color.Color
+	if d.hasTransparentIndex && int(d.transparentIndex) < len(p) {
+		transparent = p[d.transparentIndex]
+		p = append(color.Palette(nil), p...)
+		p[d.transparentIndex] = color.RGBA{}
+	}
+	m := d.newFrame(visible, p)
+	d.block = "image data"
+	litWidth, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if litWidth < 2 || litWidth > 8 {
+		return fmt.Errorf("gif: pixel size in decode out of range: %d", litWidth)
+	}
+	if visible != bounds {
+		return d.readClippedPixels(m, bounds, int(litWidth), transparent)
+	}
+	// Interlaced pixels are decoded into scratch space, without gaps
+	// between the rows, and then copied to their rows.
+	dx := m.Rect.Dx()
+	pix, stride := m.Pix, m.Stride
+	interlaced := d.imageFields&ifInterlace != 0
+	if interlaced {
+		pix, stride = d.scratch(dx*m.Rect.Dy()), dx
+	}
+	lzwr := d.lzwDecoder()
+	lzwr.reset(d.r, pix, dx, stride, int(litWidth), len(m.Palette), !d.lenient)
+	// truncated is set when the file ends inside the image data. Only
+	// lenient decoding gets past that point, keeping this last frame.
+	var truncated error
+	if n, err := d.readPixels(lzwr, m, interlaced); err != nil {
+		if !d.lenient {
+			if err != io.ErrUnexpectedEOF {
 				return err
 			}
-			if litWidth < 2 || litWidth > 8 {
-				return fmt.Errorf("gif: pixel size in decode out of range: %d", litWidth)
-			}
-			// A wonderfully Go-like piece of magic.
-			br := &blockReader{r: d.r}
-			lzwr := lzw.NewReader(br, lzw.LSB, int(litWidth))
-			defer lzwr.Close()
-			if _, err = io.ReadFull(lzwr, m.Pix); err != nil {
-				if err != io.ErrUnexpectedEOF {
-					return err
-				}
-				return errNotEnough
-			}
-			// Both lzwr and br should be exhausted. Reading from them
-			// should yield (0, io.EOF).
-			if n, err := lzwr.Read(d.tmp[:1]); n != 0 || err != io.EOF {
-				if err != nil {
-					return err
+			return errNotEnough
+		}
+		d.warn("gif: not enough image data; padded %d of %d pixels", lzwr.size-n, lzwr.size)
+		lzwr.rows(n, lzwr.size, d.pad)
+		truncated = lzwr.skip()
+	} else if err := lzwr.exhausted(); err != nil {
+		if !d.lenient {
+			return err
+		}
+		if err != errTooMuch {
+			truncated = err
+		} else {
+			d.warn("gif: too much image data; ignored the excess")
+			truncated = lzwr.skip()
+		}
+	}
+
+	if lzwr.badPixel {
+		lzwr.rows(0, lzwr.size, d.pixelChecker(len(m.Palette)))
+	}
+
+	// Undo the interlacing if necessary.
+	if interlaced {
+		uninterlace(m.Pix, pix, dx, m.Stride)
+	}
+
+	d.appendFrame(m, transparent)
+	d.resetGraphicControl()
+	return truncated
+}
+
+// readClippedPixels decodes the image data of a frame with the given
+// bounds into m, which holds only the part of it on the screen, and
+// appends m to the frames. The data is decompressed a row at a time, and
+// the rest of each row discarded. Only lenient decoding gets here.
+func (d *decoder) readClippedPixels(m *image.Paletted, bounds image.Rectangle, litWidth int, transparent color.Color) error {
+	dx, dy := bounds.Dx(), bounds.Dy()
+	r := m.Rect
+	// Rows not decoded keep the padding color.
+	frameRows(m, d.pad)
+	decoded := make([]bool, r.Dy())
+	br := &subBlockReader{r: d.r}
+	lzwr := lzw.NewReader(br, lzw.LSB, litWidth)
+	defer lzwr.Close()
+	row := d.scratch(dx)
+	frame := len(d.image)
+	interlaced := d.imageFields&ifInterlace != 0
+	passes := []interlaceScan{{1, 0}}
+	if interlaced {
+		passes = interlacing
+	}
+	rows := 0
+	var err error
+loop:
+	for i, pass := range passes {
+		for y := pass.start; y < dy; y += pass.skip {
+			var n int
+			n, err = io.ReadFull(lzwr, row)
+			if y += bounds.Min.Y; r.Min.Y <= y && y < r.Max.Y {
+				// Keep what there is of a last, partial row.
+				x0, x1 := r.Min.X-bounds.Min.X, r.Max.X-bounds.Min.X
+				copy(m.Pix[m.PixOffset(r.Min.X, y):], row[x0:max(x0, min(x1, n))])
+				decoded[y-r.Min.Y] = true
+				rows++
+				if !interlaced && d.onRows != nil {
+					d.onRows(frame, rows, m)
 				}
-				return errTooMuch
 			}
-			if n, err := br.Read(d.tmp[:1]); n != 0 || err != io.EOF {
-				if err != nil {
-					return err
-				}
-				return errTooMuch
+			if err != nil {
+				break loop
 			}
+		}
+		if interlaced && d.onPass != nil {
+			fillRows(m, decoded)
+			d.onPass(frame, i, m)
+		}
+	}
+	if err != nil {
+		d.warn("gif: not enough image data; padded %d of %d rows", r.Dy()-rows, r.Dy())
+	} else if n, _ := lzwr.Read(row[:1]); n > 0 {
+		d.warn("gif: too much image data; ignored the excess")
+	}
+	// An error from the input, rather than the image data, ends decoding.
+	truncated := br.skip()
+	frameRows(m, d.pixelChecker(len(m.Palette)))
+	d.appendFrame(m, transparent)
+	d.resetGraphicControl()
+	return truncated
+}
 
-			// Check that the color indexes are inside the palette.
-			if len(m.Palette) < 256 {
-				for _, pixel := range m.Pix {
-					if int(pixel) >= len(m.Palette) {
-						return errBadPixel
-					}
-				}
-			}
+// frameRows calls f with each row of m's pixels.
+func frameRows(m *image.Paletted, f func(pix []uint8)) {
+	r := m.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		f(m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)])
+	}
+}
 
-			// Undo the interlacing if necessary.
-			if d.imageFields&ifInterlace != 0 {
-				uninterlace(m)
-			}
+// fillRows fills each row of m not yet decoded with a copy of the nearest
+// decoded row above it.
+func fillRows(m *image.Paletted, decoded []bool) {
+	dx := m.Rect.Dx()
+	src := -1
+	for y, ok := range decoded {
+		if ok {
+			src = y
+		} else if src >= 0 {
+			copy(m.Pix[y*m.Stride:y*m.Stride+dx], m.Pix[src*m.Stride:src*m.Stride+dx])
+		}
+	}
+}
 
-			d.image = append(d.image, m)
-			d.delay = append(d.delay, d.delayTime)
-			// The GIF89a spec, Section 23 (Graphic Control Extension) says:
-			// "The scope of this extension is the first graphic rendering block
-			// to follow." We therefore reset the GCE fields to zero.
-			d.delayTime = 0
-			d.hasTransparentIndex = false
+// subBlockReader reads the data of the data sub-blocks that follow, up to
+// the block terminator.
+type subBlockReader struct {
+	r reader
+	n int // Bytes left in the current sub-block.
+	// done is set once the block terminator has been read.
+	done bool
+}
 
-		case sTrailer:
-			if len(d.image) == 0 {
-				return io.ErrUnexpectedEOF
+func (b *subBlockReader) Read(p []byte) (int, error) {
+	for b.n == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		n, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
+			return 0, err
+		}
+		if n == 0 {
+			b.done = true
+			return 0, io.EOF
+		}
+		b.n = int(n)
+	}
+	if len(p) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// skip discards the rest of the sub-blocks, up to and including the block
+// terminator. It returns a non-nil error if the input ends first.
+func (b *subBlockReader) skip() error {
+	for {
+		if _, err := io.CopyN(ioutil.Discard, b.r, int64(b.n)); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		b.n = 0
+		if b.done {
 			return nil
+		}
+		n, err := b.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if n == 0 {
+			b.done = true
+		}
+		b.n = int(n)
+	}
+}
 
-		default:
-			return fmt.Errorf("gif: unknown block type: 0x%.2x", c)
+// appendFrame records a decoded frame, shown for the current delay time.
+// transparent is the original color of its transparent palette entry, or
+// nil if it has none.
+func (d *decoder) appendFrame(m *image.Paletted, transparent color.Color) {
+	d.image = append(d.image, m)
+	d.delay = append(d.delay, d.delayTime)
+	d.transparent = append(d.transparent, transparent)
+}
+
+// readPixels decodes the image data of m with lzwr, into m.Pix or, for
+// interlaced images, scratch space. It calls the progress callbacks, if
+// any, as the rows arrive, and returns the number of pixels read.
+func (d *decoder) readPixels(lzwr *lzwDecoder, m *image.Paletted, interlaced bool) (int, error) {
+	dx, dy := m.Rect.Dx(), m.Rect.Dy()
+	frame := len(d.image)
+	// readRows reads the next rows and checks them so that the callbacks
+	// never see pixels outside the palette. The decoder may run ahead of
+	// the rows asked for.
+	n, end := 0, 0
+	readRows := func(rows int) error {
+		end += rows * dx
+		err := lzwr.fill(end)
+		if lzwr.badPixel {
+			lzwr.rows(n, lzwr.n, d.pixelChecker(len(m.Palette)))
+		}
+		n = lzwr.n
+		return err
+	}
+	switch {
+	case interlaced && d.onPass != nil:
+		for i, pass := range interlacing {
+			rows := 0
+			if dy > pass.start {
+				rows = (dy - pass.start + pass.skip - 1) / pass.skip
+			}
+			if err := readRows(rows); err != nil {
+				return n, err
+			}
+			uninterlacePasses(m.Pix, lzwr.dst, dx, m.Stride, i+1)
+			d.onPass(frame, i, m)
+		}
+		return n, nil
+	case !interlaced && d.onRows != nil:
+		for y := 0; y < dy; y++ {
+			if err := readRows(1); err != nil {
+				return n, err
+			}
+			d.onRows(frame, y+1, m)
 		}
+		return n, nil
 	}
+	err := lzwr.fill(lzwr.size)
+	return lzwr.n, err
+}
+
+// checkPixels replaces the color indexes in pix that are outside a palette
+// of n colors, and reports whether there were any. Only lenient decoding
+// gets here; otherwise the LZW decoder has already rejected them.
+func (d *decoder) checkPixels(pix []uint8, n int) bool {
+	for i, pixel := range pix {
+		if int(pixel) >= n {
+			d.warn("gif: invalid pixel value %d; replaced", pixel)
+			d.replaceBadPixels(pix[i:], n)
+			return true
+		}
+	}
+	return false
+}
+
+// pixelChecker returns a function that checks the pixels given to it in
+// turn as checkPixels does, warning only once.
+func (d *decoder) pixelChecker(n int) func(pix []uint8) {
+	warned := false
+	return func(pix []uint8) {
+		if warned {
+			d.replaceBadPixels(pix, n)
+		} else {
+			warned = d.checkPixels(pix, n)
+		}
+	}
+}
+
+// resetGraphicControl clears the graphic control state once it has been
+// applied. The GIF89a spec, Section 23 (Graphic Control Extension) says:
+// "The scope of this extension is the first graphic rendering block
+// to follow." We therefore reset the GCE fields to zero.
+func (d *decoder) resetGraphicControl() {
+	d.delayTime = 0
+	d.hasTransparentIndex = false
+}
+
+// warn records a problem that lenient decoding worked around.
+func (d *decoder) warn(format string, a ...interface{}) {
+	d.warnings = append(d.warnings, d.wrap(fmt.Errorf(format, a...)))
+}
+
+// padIndex returns the color index used to fill in missing pixels: the
+// transparent index if there is one, so that whatever is beneath the frame
+// shows through, and 0 otherwise.
+func (d *decoder) padIndex() uint8 {
+	if d.hasTransparentIndex {
+		return d.transparentIndex
+	}
+	return 0
+}
+
+// pad fills pix with the padding color index.
+func (d *decoder) pad(pix []uint8) {
+	p := d.padIndex()
+	for i := range pix {
+		pix[i] = p
+	}
+}
+
+// replaceBadPixels replaces the color indexes in pix that are outside a
+// palette of n colors with the padding color index, or with 0 if that is
+// itself out of range.
+func (d *decoder) replaceBadPixels(pix []uint8, n int) {
+	p := d.padIndex()
+	if int(p) >= n {
+		p = 0
+	}
+	for i, pixel := range pix {
+		if int(pixel) >= n {
+			pix[i] = p
+		}
+	}
+}
+
+// blankImage returns a frame covering the logical screen, filled with the
+// background color.
+func (d *decoder) blankImage() (*image.Paletted, error) {
+	bounds := image.Rect(0, 0, d.width, d.height)
+	if err := d.checkLimits(bounds); err != nil {
+		return nil, err
+	}
+	p := d.globalColorMap
+	if len(p) == 0 {
+		p = color.Palette{color.RGBA{}}
+	}
+	m := d.newFrame(bounds, p)
+	b := uint8(0)
+	if int(d.backgroundIndex) < len(p) {
+		b = d.backgroundIndex
+	}
+	for i := range m.Pix {
+		m.Pix[i] = b
+	}
+	return m, nil
+}
+
+// newFrame returns a frame with the given bounds and palette, reusing the
+// caller's buffer for the next frame if it is large enough. The pixels
+// are not cleared.
+func (d *decoder) newFrame(r image.Rectangle, p color.Palette) *image.Paletted {
+	if d.buffers != nil && len(d.image) < len(d.buffers.Frames) {
+		m := d.buffers.Frames[len(d.image)]
+		if m != nil {
+			// Keep the frame's stride if its rows are wide enough.
+			dx, dy := r.Dx(), r.Dy()
+			stride := max(m.Stride, dx)
+			n := 0
+			if dx > 0 && dy > 0 {
+				n = (dy-1)*stride + dx
+			}
+			if cap(m.Pix) >= n {
+				m.Pix = m.Pix[:n]
+				m.Stride = stride
+				m.Rect = r
+				m.Palette = p
+				return m
+			}
+		}
+	}
+	return image.NewPaletted(r, p)
+}
+
+// scratch returns n bytes of scratch space.
+func (d *decoder) scratch(n int) []byte {
+	if d.buffers == nil {
+		return make([]byte, n)
+	}
+	if cap(d.buffers.scratch) < n {
+		d.buffers.scratch = make([]byte, n)
+	}
+	return d.buffers.scratch[:n]
+}
+
+// lzwDecoder returns the LZW decoder to use, reusing the previous one if
+// there is one.
+func (d *decoder) lzwDecoder() *lzwDecoder {
+	p := &d.lzwd
+	if d.buffers != nil {
+		p = &d.buffers.lzwd
+	}
+	if *p == nil {
+		*p = new(lzwDecoder)
+	}
+	return *p
+}
+
+// checkLimits checks that adding a frame with the given bounds, shown for
+// the current delay time, stays within the decoding limits. It is called
+// before the frame is allocated, and accounts for it if it is allowed.
+func (d *decoder) checkLimits(bounds image.Rectangle) error {
+	pixels := int64(bounds.Dx()) * int64(bounds.Dy())
+	if d.maxFrames > 0 && len(d.image) >= d.maxFrames {
+		return fmt.Errorf("%w: more than %d frames", ErrLimitExceeded, d.maxFrames)
+	}
+	if d.maxFramePixels > 0 && pixels > int64(d.maxFramePixels) {
+		return fmt.Errorf("%w: frame of %d pixels is larger than %d", ErrLimitExceeded, pixels, d.maxFramePixels)
+	}
+	if d.maxBytes > 0 && d.decodedBytes+pixels > d.maxBytes {
+		return fmt.Errorf("%w: more than %d bytes of decoded frames", ErrLimitExceeded, d.maxBytes)
+	}
+	if d.maxDuration > 0 && delayDuration(d.totalDelay+d.delayTime) > d.maxDuration {
+		return fmt.Errorf("%w: animation longer than %v", ErrLimitExceeded, d.maxDuration)
+	}
+	d.decodedBytes += pixels
+	d.totalDelay += d.delayTime
+	return nil
+}
+
+// delayDuration converts a delay time in 100ths of a second to a
+// time.Duration.
+func delayDuration(delay int) time.Duration {
+	return time.Duration(delay) * 10 * time.Millisecond
 }
 
 func (d *decoder) readHeaderAndScreenDescriptor() error {
@@ -302,7 +836,12 @@ func (d *decoder) readExtension() error {
 	case eGraphicControl:
 		return d.readGraphicControl()
 	case eComment:
-		// nothing to do but read the data.
+		text, err := d.readSubBlocks()
+		if err != nil {
+			return err
+		}
+		d.comments = append(d.comments, Comment{Frame: len(d.delay), Text: string(text)})
+		return nil
 	case eApplication:
 		b, err := d.r.ReadByte()
 		if err != nil {
@@ -311,7 +850,20 @@ func (d *decoder) readExtension() error {
 		// The spec requires size be 11, but Adobe sometimes uses 10.
 		size = int(b)
 	default:
-		return fmt.Errorf("gif: unknown extension 0x%.2x", extension)
+		// The block structure lets any extension be skipped.
+		if !d.keepUnknown {
+			break
+		}
+		data, err := d.readSubBlocks()
+		if err != nil {
+			return err
+		}
+		d.unknown = append(d.unknown, RawExtension{
+			Frame: len(d.delay),
+			Label: extension,
+			Data:  data,
+		})
+		return nil
 	}
 	if size > 0 {
 		if _, err := io.ReadFull(d.r, d.tmp[0:size]); err != nil {
@@ -319,22 +871,115 @@ func (d *decoder) readExtension() error {
 		}
 	}
 
-	// Application Extension with "NETSCAPE2.0" as string and 1 in data means
-	// this extension defines a loop count.
-	if extension == eApplication && string(d.tmp[:size]) == "NETSCAPE2.0" {
+	switch extension {
+	case eText:
+		return d.readPlainText()
+	case eApplication:
+		// Application Extension with "NETSCAPE2.0" as string and 1 in data
+		// means this extension defines a loop count.
+		if string(d.tmp[:size]) == "NETSCAPE2.0" {
+			n, err := d.readBlock()
+			if n == 0 || err != nil {
+				return err
+			}
+			if n == 3 && d.tmp[0] == 1 {
+				d.loopCount = int(d.tmp[1]) | int(d.tmp[2])<<8
+			}
+			break
+		}
+		return d.readApplication(size)
+	}
+	for {
 		n, err := d.readBlock()
 		if n == 0 || err != nil {
 			return err
 		}
-		if n == 3 && d.tmp[0] == 1 {
-			d.loopCount = int(d.tmp[1]) | int(d.tmp[2])<<8
+	}
+}
+
+// readPlainText reads the text of a plain text extension whose header is
+// in d.tmp[0:13].
+func (d *decoder) readPlainText() error {
+	t := PlainText{
+		Frame:      len(d.delay),
+		Left:       int(d.tmp[1]) | int(d.tmp[2])<<8,
+		Top:        int(d.tmp[3]) | int(d.tmp[4])<<8,
+		Width:      int(d.tmp[5]) | int(d.tmp[6])<<8,
+		Height:     int(d.tmp[7]) | int(d.tmp[8])<<8,
+		CellWidth:  int(d.tmp[9]),
+		CellHeight: int(d.tmp[10]),
+		Foreground: d.tmp[11],
+		Background: d.tmp[12],
+	}
+	text, err := d.readSubBlocks()
+	if err != nil {
+		return err
+	}
+	t.Text = string(text)
+	d.plainTexts = append(d.plainTexts, t)
+	return nil
+}
+
+// xmpTrailer is the "magic trailer" that follows XMP data stored in an
+// application extension, so that readers skipping sub-blocks land on the
+// block terminator: 0x01, 0xFF, 0xFE, ..., 0x01, 0x00.
+var xmpTrailer = func() []byte {
+	b := []byte{0x01}
+	for i := 0xFF; i >= 0; i-- {
+		b = append(b, uint8(i))
+	}
+	return b
+}()
+
+// readApplication reads the data of an application extension whose
+// identifier and authentication code are in d.tmp[0:size].
+func (d *decoder) readApplication(size int) error {
+	n := min(size, 8)
+	a := Application{
+		Frame:      len(d.delay),
+		Identifier: string(d.tmp[:n]),
+		AuthCode:   string(d.tmp[n:size]),
+	}
+	if a.Identifier == "XMP Data" && a.AuthCode == "XMP" {
+		// XMP data is stored raw rather than split into sub-blocks, so
+		// the length bytes are part of it.
+		for {
+			n, err := d.readBlock()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			a.Data = append(a.Data, uint8(n))
+			a.Data = append(a.Data, d.tmp[:n]...)
+		}
+		if bytes.HasSuffix(a.Data, xmpTrailer) {
+			a.Data = a.Data[:len(a.Data)-len(xmpTrailer)]
+		}
+	} else {
+		var err error
+		if a.Data, err = d.readSubBlocks(); err != nil {
+			return err
 		}
 	}
+	d.applications = append(d.applications, a)
+	return nil
+}
+
+// readSubBlocks reads data sub-blocks up to and including the block
+// terminator and returns their contents joined together.
+func (d *decoder) readSubBlocks() ([]byte, error) {
+	var data []byte
 	for {
 		n, err := d.readBlock()
-		if n == 0 || err != nil {
-			return err
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
 		}
+		data = append(data, d.tmp[:n]...)
 	}
 }
 
@@ -351,9 +996,31 @@ func (d *decoder) readGraphicControl() error {
 	return nil
 }
 
-func (d *decoder) newImageFromDescriptor() (*image.Paletted, error) {
+// skipImageData skips over the image data following an image descriptor
+// without decompressing it, recording only the frame's bounds and timing.
+func (d *decoder) skipImageData(bounds image.Rectangle) error {
+	if _, err := d.r.ReadByte(); err != nil { // LZW Minimum Code Size.
+		return err
+	}
+	for {
+		n, err := d.readBlock()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	d.bounds = append(d.bounds, bounds)
+	d.delay = append(d.delay, d.delayTime)
+	d.totalDelay += d.delayTime
+	d.resetGraphicControl()
+	return nil
+}
+
+func (d *decoder) readImageDescriptor() (image.Rectangle, error) {
 	if _, err := io.ReadFull(d.r, d.tmp[0:9]); err != nil {
-		return nil, fmt.Errorf("gif: can't read image descriptor: %s", err)
+		return image.Rectangle{}, fmt.Errorf("gif: can't read image descriptor: %s", err)
 	}
 	left := int(d.tmp[0]) + int(d.tmp[1])<<8
 	top := int(d.tmp[2]) + int(d.tmp[3])<<8
@@ -365,10 +1032,10 @@ func (d *decoder) newImageFromDescriptor() (*image.Paletted, error) {
 	// "Each image must fit within the boundaries of the Logical
 	// Screen, as defined in the Logical Screen Descriptor."
 	bounds := image.Rect(left, top, left+width, top+height)
-	if bounds != bounds.Intersect(image.Rect(0, 0, d.width, d.height)) {
-		return nil, errors.New("gif: frame bounds larger than image bounds")
+	if !d.lenient && !bounds.In(image.Rect(0, 0, d.width, d.height)) {
+		return image.Rectangle{}, errors.New("gif: frame bounds larger than image bounds")
 	}
-	return image.NewPaletted(bounds, nil), nil
+	return bounds, nil
 }
 
 func (d *decoder) readBlock() (int, error) {
@@ -392,40 +1059,67 @@ var interlacing = []interlaceScan{
 	{2, 1}, // Group 4 : Every 2nd. row, starting with row 1.
 }
 
-// uninterlace rearranges the pixels in m to account for interlaced input.
-func uninterlace(m *image.Paletted) {
-	var nPix []uint8
-	dx := m.Bounds().Dx()
-	dy := m.Bounds().Dy()
-	nPix = make([]uint8, dx*dy)
+// uninterlace copies the interlaced rows of width dx in src to their
+// places in dst, rows of which start every stride bytes.
+func uninterlace(dst, src []uint8, dx, stride int) {
+	if dx == 0 {
+		return
+	}
+	dy := len(src) / dx
 	offset := 0 // steps through the input by sequential scan lines.
 	for _, pass := range interlacing {
-		nOffset := pass.start * dx // steps through the output as defined by pass.
+		nOffset := pass.start * stride // steps through the output as defined by pass.
 		for y := pass.start; y < dy; y += pass.skip {
-			copy(nPix[nOffset:nOffset+dx], m.Pix[offset:offset+dx])
+			copy(dst[nOffset:nOffset+dx], src[offset:offset+dx])
 			offset += dx
-			nOffset += dx * pass.skip
+			nOffset += stride * pass.skip
+		}
+	}
+}
+
+// uninterlacePasses copies the rows of width dx of the first passes
+// interlace passes in src to their places in dst, rows of which start every
+// stride bytes, and fills each row still missing with a copy of the nearest
+// one above it.
+func uninterlacePasses(dst, src []uint8, dx, stride, passes int) {
+	if dx == 0 {
+		return
+	}
+	dy := len(src) / dx
+	offset := 0
+	for _, pass := range interlacing[:passes] {
+		for y := pass.start; y < dy; y += pass.skip {
+			copy(dst[y*stride:y*stride+dx], src[offset:offset+dx])
+			offset += dx
+		}
+	}
+	// The passes so far include every skip'th row.
+	skip := 8 >> uint(passes-1)
+	for y := 0; y < dy; y++ {
+		if y%skip != 0 {
+			src := (y - y%skip) * stride
+			copy(dst[y*stride:y*stride+dx], dst[src:src+dx])
 		}
 	}
-	m.Pix = nPix
 }
 
 // Decode reads a GIF image from r and returns the first embedded
-// image as an image.Image.
+// image as an image.Image. Its errors are not wrapped in a DecodeError;
+// DecodeAllOptions reports where in r decoding failed.
 func Decode(r io.Reader) (image.Image, error) {
 	var d decoder
 	if err := d.decode(r, false); err != nil {
-		return nil, err
+		return nil, unwrapDecodeError(err)
 	}
 	return d.image[0], nil
 }
 
 // DecodeAll reads a GIF image from r and returns the sequential frames
-// and timing information.
+// and timing information. As with Decode, its errors are not wrapped.
 func DecodeAll(r io.Reader) (*gif.GIF, error) {
 	var d decoder
 	if err := d.decode(r, false); err != nil {
-		return nil, err
+		return nil, unwrapDecodeError(err)
 	}
 	gif := &gif.GIF{
 		Image:     d.image,
@@ -435,12 +1129,198 @@ func DecodeAll(r io.Reader) (*gif.GIF, error) {
 	return gif, nil
 }
 
+// DecodeOptions are the decoding parameters.
+type DecodeOptions struct {
+	// Lenient makes the decoder recover what it can from truncated or
+	// malformed files, as browsers do, instead of failing. Frames decoded
+	// before an unrecoverable error are kept, short frames are padded,
+	// frames extending past the logical screen are clipped and unknown
+	// bytes between blocks are skipped. Each fix is reported in
+	// GIF.Warnings.
+	Lenient bool
+
+	// Limits for decoding untrusted input. Each is checked before the
+	// frame that would pass it is allocated, and decoding then fails with
+	// an error wrapping ErrLimitExceeded. Zero means no limit.
+
+	// MaxFramePixels is the largest number of pixels in a single frame.
+	MaxFramePixels int
+	// MaxFrames is the largest number of frames.
+	MaxFrames int
+	// MaxDecodedBytes is the largest total size of the decoded frames'
+	// pixel data.
+	MaxDecodedBytes int64
+	// MaxDuration is the longest total animation time, the sum of the
+	// frame delays.
+	MaxDuration time.Duration
+
+	// KeepUnknownExtensions keeps the extensions with labels the decoder
+	// does not know in GIF.UnknownExtensions. They are skipped otherwise.
+	KeepUnknownExtensions bool
+
+	// CountTrailingData reads the input to its end after the trailer and
+	// counts the bytes there in GIF.TrailingData. Otherwise decoding stops
+	// at the trailer. A StreamReader ignores it, as what follows each
+	// image is the next one.
+	CountTrailingData bool
+
+	// OnPass, if non-nil, is called after each of the four passes of an
+	// interlaced frame has been decoded, with the frame's index, the pass
+	// number from 0 to 3, and the partly decoded frame. Rows not yet
+	// decoded are filled with a copy of the nearest decoded row above.
+	OnPass func(frame, pass int, m *image.Paletted)
+	// OnRows, if non-nil, is called after each row of a frame that is not
+	// interlaced has been decoded, with the frame's index, the number of
+	// rows decoded so far, and the partly decoded frame.
+	OnRows func(frame, rows int, m *image.Paletted)
+
+	// Buffers, if non-nil, provides memory to decode into. It is updated
+	// to hold the decoded frames, which are overwritten by the next
+	// decode using the same Buffers.
+	Buffers *Buffers
+}
+
+// Buffers holds memory that decoding reuses from one image to the next,
+// reducing allocation when decoding many images. A Buffers must not be
+// used by more than one decode at a time.
+type Buffers struct {
+	// Frames are decoded into in order. A frame's Pix is reused if it is
+	// large enough, as is its Stride if that is at least the new frame's
+	// width; otherwise a new frame is allocated in its place.
+	Frames []*image.Paletted
+
+	br      *bufio.Reader
+	lzwd    *lzwDecoder
+	scratch []byte
+}
+
+// GIF represents the possibly multiple images stored in a GIF file,
+// along with the problems worked around while decoding it.
+type GIF struct {
+	gif.GIF
+	// TransparentColor holds, for each frame, the color its palette gave
+	// the transparent color index before that entry was made transparent,
+	// or nil if the frame has no transparent color.
+	TransparentColor []color.Color
+	// Comments, PlainTexts and Applications hold the comment, plain text
+	// and application extensions, other than the NETSCAPE2.0 loop count,
+	// in the order they appear. The Frame of each extension, here and in
+	// UnknownExtensions, is the index of the frame it comes before, or the
+	// number of frames if it comes after the last one.
+	Comments     []Comment
+	PlainTexts   []PlainText
+	Applications []Application
+	// UnknownExtensions holds the extensions with unknown labels, if
+	// DecodeOptions.KeepUnknownExtensions is set.
+	UnknownExtensions []RawExtension
+	// Warnings lists the problems that lenient decoding recovered from,
+	// each as a *DecodeError.
+	Warnings []error
+	// TrailingData is the number of bytes after the trailer, if
+	// DecodeOptions.CountTrailingData is set.
+	TrailingData int64
+}
+
+// Comment is a comment extension.
+type Comment struct {
+	Frame int // See GIF.Comments.
+	Text  string
+}
+
+// PlainText is a plain text extension, which asks for text to be rendered
+// on a grid of character cells.
+type PlainText struct {
+	Frame int // See GIF.Comments.
+	// The text grid's position and size on the logical screen, in pixels.
+	Left, Top, Width, Height int
+	// The size of each character cell, in pixels.
+	CellWidth, CellHeight int
+	// The global color table indexes of the text and its background.
+	Foreground, Background byte
+	Text                   string
+}
+
+// Application is an application extension.
+type Application struct {
+	Frame      int    // See GIF.Comments.
+	Identifier string // The 8-byte application identifier.
+	AuthCode   string // The 3-byte application authentication code.
+	// Data holds the contents of the data sub-blocks joined together. For
+	// XMP ("XMP Data", "XMP") it holds the XMP packet instead.
+	Data []byte
+}
+
+// RawExtension is an extension block that the decoder does not interpret.
+type RawExtension struct {
+	Frame int // See GIF.Comments.
+	Label byte
+	// Data holds the contents of the data sub-blocks joined together.
+	Data []byte
+}
+
+// DecodeAllOptions reads a GIF image from r using the given options and
+// returns the sequential frames and timing information. A nil o decodes
+// the same way as DecodeAll, but errors are returned as a *DecodeError.
+func DecodeAllOptions(r io.Reader, o *DecodeOptions) (*GIF, error) {
+	d := newDecoder(o)
+	d.countTrailing = o != nil && o.CountTrailingData
+	if err := d.decode(r, false); err != nil {
+		return nil, err
+	}
+	return d.result(), nil
+}
+
+// newDecoder returns a decoder set up with the options o, which may be nil.
+func newDecoder(o *DecodeOptions) *decoder {
+	d := new(decoder)
+	if o != nil {
+		d.lenient = o.Lenient
+		d.maxFramePixels = o.MaxFramePixels
+		d.maxFrames = o.MaxFrames
+		d.maxBytes = o.MaxDecodedBytes
+		d.maxDuration = o.MaxDuration
+		d.keepUnknown = o.KeepUnknownExtensions
+		d.onPass = o.OnPass
+		d.onRows = o.OnRows
+		d.buffers = o.Buffers
+	}
+	return d
+}
+
+// result returns what d decoded, updating the Buffers if there are any.
+func (d *decoder) result() *GIF {
+	if b := d.buffers; b != nil {
+		for i, m := range d.image {
+			if i < len(b.Frames) {
+				b.Frames[i] = m
+			} else {
+				b.Frames = append(b.Frames, m)
+			}
+		}
+	}
+	return &GIF{
+		GIF: gif.GIF{
+			Image:     d.image,
+			LoopCount: d.loopCount,
+			Delay:     d.delay,
+		},
+		TransparentColor:  d.transparent,
+		Comments:          d.comments,
+		PlainTexts:        d.plainTexts,
+		Applications:      d.applications,
+		UnknownExtensions: d.unknown,
+		Warnings:          d.warnings,
+		TrailingData:      d.trailing,
+	}
+}
+
 // DecodeConfig returns the global color model and dimensions of a GIF image
-// without decoding the entire image.
+// without decoding the entire image. As with Decode, its errors are not
+// wrapped.
 func DecodeConfig(r io.Reader) (image.Config, error) {
 	var d decoder
 	if err := d.decode(r, true); err != nil {
-		return image.Config{}, err
+		return image.Config{}, unwrapDecodeError(err)
 	}
 	return image.Config{
 		ColorModel: d.globalColorMap,
@@ -3,10 +3,14 @@ package gogif
 import (
 	"bytes"
 	"compress/lzw"
+	"errors"
 	"image"
 	"image/color"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // header, palette and trailer are parts of a valid 2x1 GIF image.
@@ -195,3 +199,536 @@ func TestPixelOutsidePaletteRange(t *testing.T) {
 		try(t, b.Bytes(), want)
 	}
 }
+
+func TestLenient(t *testing.T) {
+	// Make local copies of testGIF.
+	clone := func() []byte {
+		b := make([]byte, len(testGIF))
+		copy(b, testGIF)
+		return b
+	}
+	truncated := clone()[:len(testGIF)-4]
+	junk := clone()
+	junk = append(junk[:len(junk)-1], 0x00, 0x17, 0x3b)
+	oversized := clone()
+	oversized[32] = 2
+	noImages := []byte(headerStr + paletteStr + trailerStr)
+
+	testCases := []struct {
+		desc   string
+		gif    []byte
+		bounds image.Rectangle
+	}{
+		{"truncated", truncated, image.Rect(0, 0, 1, 1)},
+		{"junk", junk, image.Rect(0, 0, 1, 1)},
+		{"oversized", oversized, image.Rect(0, 0, 1, 1)},
+		{"no images", noImages, image.Rect(0, 0, 2, 1)},
+	}
+	for _, tc := range testCases {
+		if _, err := DecodeAll(bytes.NewReader(tc.gif)); err == nil {
+			t.Errorf("%s: strict decoding succeeded", tc.desc)
+		}
+		g, err := DecodeAllOptions(bytes.NewReader(tc.gif), &DecodeOptions{Lenient: true})
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if len(g.Image) != 1 || len(g.Delay) != 1 {
+			t.Errorf("%s: got %d images and %d delays, want 1", tc.desc, len(g.Image), len(g.Delay))
+			continue
+		}
+		if got := g.Image[0].Bounds(); got != tc.bounds {
+			t.Errorf("%s: got bounds %v, want %v", tc.desc, got, tc.bounds)
+		}
+		if len(g.Warnings) == 0 {
+			t.Errorf("%s: no warnings reported", tc.desc)
+		}
+	}
+
+	// A valid file decodes without warnings.
+	g, err := DecodeAllOptions(bytes.NewReader(testGIF), &DecodeOptions{Lenient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Warnings) != 0 {
+		t.Errorf("got warnings %v, want none", g.Warnings)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// twoFrames is testGIF with a second copy of its graphic control
+	// extension and frame, each shown for half a second.
+	twoFrames := make([]byte, 0, 2*len(testGIF))
+	twoFrames = append(twoFrames, testGIF[:len(testGIF)-1]...)
+	twoFrames = append(twoFrames, testGIF[19:]...)
+	twoFrames[23] = 50
+	twoFrames[len(testGIF)-1+4] = 50
+
+	// huge declares a 65535x65535 screen and frame.
+	huge := make([]byte, len(testGIF))
+	copy(huge, testGIF)
+	for i := 0; i < 4; i++ {
+		huge[6+i] = 0xff
+		huge[32+i] = 0xff
+	}
+
+	testCases := []struct {
+		desc    string
+		gif     []byte
+		o       DecodeOptions
+		wantErr bool
+	}{
+		{"frames", twoFrames, DecodeOptions{MaxFrames: 1}, true},
+		{"frames ok", twoFrames, DecodeOptions{MaxFrames: 2}, false},
+		{"pixels", huge, DecodeOptions{MaxFramePixels: 1 << 20}, true},
+		{"pixels ok", twoFrames, DecodeOptions{MaxFramePixels: 1}, false},
+		{"bytes", twoFrames, DecodeOptions{MaxDecodedBytes: 1}, true},
+		{"bytes ok", twoFrames, DecodeOptions{MaxDecodedBytes: 2}, false},
+		{"duration", twoFrames, DecodeOptions{MaxDuration: 500 * time.Millisecond}, true},
+		{"duration ok", twoFrames, DecodeOptions{MaxDuration: time.Second}, false},
+		{"lenient", twoFrames, DecodeOptions{MaxFrames: 1, Lenient: true}, true},
+	}
+	for _, tc := range testCases {
+		_, err := DecodeAllOptions(bytes.NewReader(tc.gif), &tc.o)
+		if tc.wantErr {
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("%s: got %v, want ErrLimitExceeded", tc.desc, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestLenientClipping(t *testing.T) {
+	// frame returns a GIF with a 2x2 screen and a frame of the given size
+	// whose rows, as stored, are rows.
+	frame := func(w, h int, interlaced bool, rows []byte) []byte {
+		b := &bytes.Buffer{}
+		b.WriteString("GIF89a\x02\x00\x02\x00\x80\x00\x00")
+		b.WriteString(paletteStr)
+		fields := byte(0)
+		if interlaced {
+			fields = ifInterlace
+		}
+		b.Write([]byte{0x2c, 0, 0, 0, 0, byte(w), byte(w >> 8), byte(h), byte(h >> 8), fields, 2})
+		enc := &bytes.Buffer{}
+		lzww := lzw.NewWriter(enc, lzw.LSB, 2)
+		lzww.Write(rows)
+		lzww.Close()
+		b.WriteByte(byte(enc.Len()))
+		b.Write(enc.Bytes())
+		b.WriteByte(0x00)
+		b.WriteString(trailerStr)
+		return b.Bytes()
+	}
+	// A 3x3 frame, of which the top left 2x2 pixels are on the screen.
+	pix := []byte{0, 1, 1, 1, 0, 0, 0, 0, 1}
+	// Interlaced, the rows are stored in the order 0, 2, 1.
+	interlaced := []byte{0, 1, 1, 0, 0, 1, 1, 0, 0}
+	want := []byte{0, 1, 1, 0}
+	for _, tc := range []struct {
+		desc string
+		gif  []byte
+	}{
+		{"progressive", frame(3, 3, false, pix)},
+		{"interlaced", frame(3, 3, true, interlaced)},
+	} {
+		// Only the part on the screen counts against the limits.
+		o := &DecodeOptions{Lenient: true, MaxFramePixels: 4}
+		g, err := DecodeAllOptions(bytes.NewReader(tc.gif), o)
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		m := g.Image[0]
+		if m.Rect != image.Rect(0, 0, 2, 2) {
+			t.Errorf("%s: got bounds %v, want %v", tc.desc, m.Rect, image.Rect(0, 0, 2, 2))
+			continue
+		}
+		if !bytes.Equal(m.Pix, want) {
+			t.Errorf("%s: got pixels %v, want %v", tc.desc, m.Pix, want)
+		}
+		if len(g.Warnings) != 1 {
+			t.Errorf("%s: got warnings %v, want one", tc.desc, g.Warnings)
+		}
+	}
+
+	// A frame declaring the largest size is not allocated in full.
+	g, err := DecodeAllOptions(bytes.NewReader(frame(0xffff, 0xffff, false, pix)), &DecodeOptions{Lenient: true, MaxFramePixels: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := g.Image[0]; len(m.Pix) != 4 || m.Pix[0] != 0 || m.Pix[1] != 1 {
+		t.Errorf("huge frame: got %d pixels %v, want the 4 on the screen", len(m.Pix), m.Pix)
+	}
+}
+
+func BenchmarkDecodeAll(b *testing.B) {
+	b.StopTimer()
+	data, err := ioutil.ReadFile("testdata/scape.gif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAll(bytes.NewReader(data))
+	}
+}
+
+func TestTransparentIndexPalette(t *testing.T) {
+	// A copy of testGIF with a second frame. Only the first frame's
+	// graphic control extension sets a transparent index.
+	b := make([]byte, 0, 2*len(testGIF))
+	b = append(b, testGIF[:len(testGIF)-1]...)
+	b = append(b, testGIF[19:]...)
+	b[22] = 0x01 // Transparent color flag.
+	b[25] = 0x01 // Transparent color index.
+
+	g, err := DecodeAllOptions(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 {
+		t.Fatalf("got %d images, want 2", len(g.Image))
+	}
+	opaque := color.RGBA{0x01, 0x01, 0x01, 0xff}
+	if got := g.Image[0].Palette[1]; got != (color.RGBA{}) {
+		t.Errorf("frame 0: got palette entry %v, want transparent", got)
+	}
+	if got := g.Image[1].Palette[1]; got != opaque {
+		t.Errorf("frame 1: got palette entry %v, want %v", got, opaque)
+	}
+	if got := g.TransparentColor[0]; got != opaque {
+		t.Errorf("frame 0: got transparent color %v, want %v", got, opaque)
+	}
+	if got := g.TransparentColor[1]; got != nil {
+		t.Errorf("frame 1: got transparent color %v, want nil", got)
+	}
+}
+
+func TestDecodeBuffers(t *testing.T) {
+	var buffers Buffers
+	for _, filename := range []string{"testdata/shapes.gif", "testdata/video-001.interlaced.gif", "testdata/blob.gif"} {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			got, err := DecodeAllOptions(bytes.NewReader(b), &DecodeOptions{Buffers: &buffers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A reused frame keeps its stride if it is wide enough.
+			if len(got.Image) != len(want.Image) {
+				t.Fatalf("%s: decode %d: got %d frames, want %d", filename, i, len(got.Image), len(want.Image))
+			}
+			for j := range got.Image {
+				if !samePaletted(got.Image[j], want.Image[j]) {
+					t.Errorf("%s: decode %d: frame %d differs from DecodeAll", filename, i, j)
+				}
+			}
+			for j, m := range got.Image {
+				if buffers.Frames[j] != m {
+					t.Fatalf("%s: frame %d is not in the buffers", filename, j)
+				}
+			}
+		}
+	}
+
+	// Decoding again into the same buffers needs little new memory.
+	b, err := ioutil.ReadFile("testdata/shapes.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &DecodeOptions{Buffers: &buffers}
+	with := testing.AllocsPerRun(5, func() {
+		DecodeAllOptions(bytes.NewReader(b), o)
+	})
+	without := testing.AllocsPerRun(5, func() {
+		DecodeAll(bytes.NewReader(b))
+	})
+	if with >= without {
+		t.Errorf("got %v allocations with buffers, %v without", with, without)
+	}
+}
+
+// samePaletted reports whether a and b have the same bounds, palette and
+// pixels, whatever their strides.
+func samePaletted(a, b *image.Paletted) bool {
+	if a.Rect != b.Rect || !reflect.DeepEqual(a.Palette, b.Palette) {
+		return false
+	}
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		i, j := a.PixOffset(a.Rect.Min.X, y), b.PixOffset(b.Rect.Min.X, y)
+		if !bytes.Equal(a.Pix[i:i+a.Rect.Dx()], b.Pix[j:j+b.Rect.Dx()]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeBuffersStride(t *testing.T) {
+	for _, filename := range []string{"testdata/shapes.gif", "testdata/video-001.interlaced.gif"} {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Decode each frame into part of a wider image, with a stride
+		// larger than the frame's width.
+		var buffers Buffers
+		var wide []*image.Paletted
+		for _, m := range want.Image {
+			r := m.Bounds()
+			w := image.NewPaletted(image.Rect(0, 0, r.Dx()+7, r.Dy()), nil)
+			for i := range w.Pix {
+				w.Pix[i] = 0xff
+			}
+			wide = append(wide, w)
+			buffers.Frames = append(buffers.Frames, w.SubImage(image.Rect(0, 0, r.Dx(), r.Dy())).(*image.Paletted))
+		}
+		// Lenient decoding with callbacks takes the other paths.
+		for _, lenient := range []bool{false, true} {
+			o := &DecodeOptions{Buffers: &buffers, Lenient: lenient}
+			if lenient {
+				o.OnPass = func(frame, pass int, m *image.Paletted) {}
+				o.OnRows = func(frame, rows int, m *image.Paletted) {}
+			}
+			got, err := DecodeAllOptions(bytes.NewReader(b), o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, m := range got.Image {
+				if m.Stride != wide[i].Stride {
+					t.Errorf("%s: frame %d: got stride %d, want %d", filename, i, m.Stride, wide[i].Stride)
+				}
+				if !samePaletted(m, want.Image[i]) {
+					t.Errorf("%s: frame %d differs from DecodeAll", filename, i)
+				}
+				// The pixels right of the frame are left alone.
+				for y := 0; y < m.Rect.Dy(); y++ {
+					if p := wide[i].Pix[y*wide[i].Stride+m.Rect.Dx()]; p != 0xff {
+						t.Fatalf("%s: frame %d: pixel beside row %d overwritten", filename, i, y)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeAllBuffers(b *testing.B) {
+	b.StopTimer()
+	data, err := ioutil.ReadFile("testdata/scape.gif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	o := &DecodeOptions{Buffers: &Buffers{}}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAllOptions(bytes.NewReader(data), o)
+	}
+}
+
+func TestUnknownExtension(t *testing.T) {
+	// testGIF with a vendor extension before its frame.
+	b := append([]byte(nil), testGIF[:19]...)
+	b = append(b, 0x21, 0x99, 0x03, 'a', 'b', 'c', 0x02, 'd', 'e', 0x00)
+	b = append(b, testGIF[19:]...)
+
+	if _, err := DecodeAll(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	g, err := DecodeAllOptions(bytes.NewReader(b), &DecodeOptions{KeepUnknownExtensions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RawExtension{{Frame: 0, Label: 0x99, Data: []byte("abcde")}}
+	if !reflect.DeepEqual(g.UnknownExtensions, want) {
+		t.Errorf("got %v, want %v", g.UnknownExtensions, want)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	xmp := "<x:xmpmeta/>"
+	b := append([]byte(nil), testGIF[:19]...)
+	// Comment.
+	b = append(b, 0x21, 0xfe, 0x02, 'h', 'i', 0x01, '!', 0x00)
+	// Plain text.
+	b = append(b, 0x21, 0x01, 0x0c, 1, 0, 2, 0, 3, 0, 4, 0, 5, 6, 7, 8, 0x03, 'a', 'b', 'c', 0x00)
+	// Application.
+	b = append(b, 0x21, 0xff, 0x0b)
+	b = append(b, "ACME0001xyz"...)
+	b = append(b, 0x02, 0x01, 0x02, 0x00)
+	// XMP, stored raw and followed by the magic trailer.
+	b = append(b, 0x21, 0xff, 0x0b)
+	b = append(b, "XMP DataXMP"...)
+	b = append(b, xmp...)
+	b = append(b, xmpTrailer...)
+	b = append(b, 0x00)
+	b = append(b, testGIF[19:len(testGIF)-1]...)
+	// A comment after the last frame.
+	b = append(b, 0x21, 0xfe, 0x03, 'e', 'n', 'd', 0x00)
+	b = append(b, trailerStr...)
+
+	g, err := DecodeAllOptions(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantComments := []Comment{{0, "hi!"}, {1, "end"}}
+	if !reflect.DeepEqual(g.Comments, wantComments) {
+		t.Errorf("comments: got %v, want %v", g.Comments, wantComments)
+	}
+	wantPlainTexts := []PlainText{{
+		Frame: 0,
+		Left:  1, Top: 2, Width: 3, Height: 4,
+		CellWidth: 5, CellHeight: 6,
+		Foreground: 7, Background: 8,
+		Text: "abc",
+	}}
+	if !reflect.DeepEqual(g.PlainTexts, wantPlainTexts) {
+		t.Errorf("plain texts: got %v, want %v", g.PlainTexts, wantPlainTexts)
+	}
+	wantApplications := []Application{
+		{Frame: 0, Identifier: "ACME0001", AuthCode: "xyz", Data: []byte{1, 2}},
+		{Frame: 0, Identifier: "XMP Data", AuthCode: "XMP", Data: []byte(xmp)},
+	}
+	if !reflect.DeepEqual(g.Applications, wantApplications) {
+		t.Errorf("applications: got %v, want %v", g.Applications, wantApplications)
+	}
+}
+
+func TestProgressCallbacks(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/video-001.interlaced.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := want.Image[0]
+	dx := final.Bounds().Dx()
+	var passes []int
+	_, err = DecodeAllOptions(bytes.NewReader(b), &DecodeOptions{
+		OnPass: func(frame, pass int, m *image.Paletted) {
+			passes = append(passes, pass)
+			// The rows decoded so far are final, and each row between
+			// them copies the one above.
+			skip := 8 >> uint(pass)
+			for y := 0; y < m.Bounds().Dy(); y++ {
+				row := m.Pix[y*dx : (y+1)*dx]
+				src := y - y%skip
+				if !bytes.Equal(row, final.Pix[src*dx:(src+1)*dx]) {
+					t.Fatalf("pass %d: row %d is not a copy of row %d", pass, y, src)
+				}
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(passes, []int{0, 1, 2, 3}) {
+		t.Errorf("got passes %v, want [0 1 2 3]", passes)
+	}
+
+	b, err = ioutil.ReadFile("testdata/video-001.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err = DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	final = want.Image[0]
+	calls := 0
+	_, err = DecodeAllOptions(bytes.NewReader(b), &DecodeOptions{
+		OnRows: func(frame, rows int, m *image.Paletted) {
+			calls++
+			if rows != calls {
+				t.Fatalf("got %d rows on call %d", rows, calls)
+			}
+			n := rows * m.Bounds().Dx()
+			if !bytes.Equal(m.Pix[:n], final.Pix[:n]) {
+				t.Fatalf("rows %d: decoded rows differ", rows)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != final.Bounds().Dy() {
+		t.Errorf("got %d calls, want %d", calls, final.Bounds().Dy())
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	// testGIF with something other than a trailer after its frame.
+	b := append([]byte(nil), testGIF...)
+	b[len(b)-1] = 0x99
+	_, err := DecodeAllOptions(bytes.NewReader(b), nil)
+	var e *DecodeError
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want a *DecodeError", err)
+	}
+	want := DecodeError{Offset: int64(len(b)), Frame: 1, Block: "block introducer"}
+	if e.Offset != want.Offset || e.Frame != want.Frame || e.Block != want.Block {
+		t.Errorf("got %+v, want %+v", *e, want)
+	}
+
+	// testGIF cut off in its image data.
+	b = testGIF[:len(testGIF)-3]
+	_, err = DecodeAllOptions(bytes.NewReader(b), nil)
+	if !errors.Is(err, errNotEnough) {
+		t.Fatalf("got %v, want errNotEnough", err)
+	}
+	errors.As(err, &e)
+	want = DecodeError{Offset: int64(len(b)), Frame: 0, Block: "image data"}
+	if e.Offset != want.Offset || e.Frame != want.Frame || e.Block != want.Block {
+		t.Errorf("got %+v, want %+v", *e, want)
+	}
+
+	// Decode, DecodeAll and DecodeConfig return the underlying error, as
+	// image/gif does.
+	if _, err := Decode(bytes.NewReader(b)); err != errNotEnough {
+		t.Errorf("Decode: got %#v, want errNotEnough", err)
+	}
+	if _, err := DecodeAll(bytes.NewReader(b)); err != errNotEnough {
+		t.Errorf("DecodeAll: got %#v, want errNotEnough", err)
+	}
+	if _, err := DecodeConfig(bytes.NewReader(testGIF[:8])); err != io.ErrUnexpectedEOF {
+		t.Errorf("DecodeConfig: got %#v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/video-001.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, "hidden payload"...)
+	g, err := DecodeAllOptions(bytes.NewReader(b), &DecodeOptions{CountTrailingData: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.TrailingData != int64(len("hidden payload")) {
+		t.Errorf("got %d bytes of trailing data, want %d", g.TrailingData, len("hidden payload"))
+	}
+	g, err = DecodeAllOptions(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.TrailingData != 0 {
+		t.Errorf("got %d bytes of trailing data without counting, want 0", g.TrailingData)
+	}
+}
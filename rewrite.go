@@ -0,0 +1,110 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"io"
+)
+
+// RewriteOptions are the parameters for Rewrite. A nil field leaves the
+// corresponding metadata unchanged.
+type RewriteOptions struct {
+	// Delay returns the new delay time, in 100ths of a second, of the
+	// given frame from its current one.
+	Delay func(frame, delay int) int
+	// LoopCount sets the loop count, as in gif.GIF. A LoopCount of -1
+	// removes the NETSCAPE2.0 application extension so that the
+	// animation is shown only once.
+	LoopCount *int
+	// StripComments removes all comment extensions.
+	StripComments bool
+}
+
+// Rewrite copies the GIF file read from r to w, changing only its timing,
+// loop count and comments as given by o. The image data is copied byte
+// for byte, without being decompressed.
+func Rewrite(w io.Writer, r io.Reader, o *RewriteOptions) error {
+	if o == nil {
+		o = &RewriteOptions{}
+	}
+	tr := NewTokenizer(r)
+	tw := NewTokenWriter(w)
+	frame := 0
+	// sawGC is whether a graphic control extension applies to the next
+	// graphic rendering block.
+	sawGC := false
+	for {
+		tok, err := tr.Next()
+		if err == io.EOF {
+			return tw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case *Header:
+			loop := o.LoopCount != nil && *o.LoopCount >= 0
+			if t.Version == "GIF87a" && (loop || o.Delay != nil) {
+				// The blocks we may add are GIF89a features.
+				t.Version = "GIF89a"
+			}
+			if err := tw.WriteToken(t); err != nil {
+				return err
+			}
+			if loop {
+				tok = netscapeExtension(*o.LoopCount)
+			} else {
+				continue
+			}
+
+		case *Extension:
+			if o.LoopCount != nil && isNetscapeExtension(t) {
+				// Replaced by the one written after the header.
+				continue
+			}
+			if o.StripComments && t.Label == eComment {
+				continue
+			}
+
+		case *GraphicControl:
+			if o.Delay != nil {
+				t.Delay = o.Delay(frame, t.Delay)
+			}
+			sawGC = true
+
+		case *ImageBlock:
+			if !sawGC && o.Delay != nil {
+				if delay := o.Delay(frame, 0); delay != 0 {
+					if err := tw.WriteToken(&GraphicControl{Delay: delay}); err != nil {
+						return err
+					}
+				}
+			}
+			sawGC = false
+			frame++
+		}
+		if err := tw.WriteToken(tok); err != nil {
+			return err
+		}
+	}
+}
+
+// isNetscapeExtension reports whether e is a NETSCAPE2.0 application
+// extension, which defines a loop count.
+func isNetscapeExtension(e *Extension) bool {
+	return e.Label == eApplication && len(e.Blocks) > 0 && string(e.Blocks[0]) == "NETSCAPE2.0"
+}
+
+// netscapeExtension returns a NETSCAPE2.0 application extension with the
+// given loop count.
+func netscapeExtension(loopCount int) *Extension {
+	return &Extension{
+		Label: eApplication,
+		Blocks: [][]byte{
+			[]byte("NETSCAPE2.0"),
+			{0x01, uint8(loopCount), uint8(loopCount >> 8)},
+		},
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/shapes.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without options, the file is copied unchanged.
+	var buf bytes.Buffer
+	if err := Rewrite(&buf, bytes.NewReader(b), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, b[:len(got)]) {
+		t.Error("Rewrite with no options changed the file")
+	}
+
+	for _, loopCount := range []int{-1, 0, 3} {
+		buf.Reset()
+		lc := loopCount
+		err := Rewrite(&buf, bytes.NewReader(b), &RewriteOptions{
+			Delay:         func(frame, delay int) int { return frame + 1 },
+			LoopCount:     &lc,
+			StripComments: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := DecodeAll(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.LoopCount != loopCount {
+			t.Errorf("got loop count %d, want %d", g.LoopCount, loopCount)
+		}
+		for i, d := range g.Delay {
+			if d != i+1 {
+				t.Errorf("frame %d: got delay %d, want %d", i, d, i+1)
+			}
+		}
+
+		// The image data must be copied as is.
+		var got, want [][]byte
+		for _, tok := range tokens(t, buf.Bytes()) {
+			if ib, ok := tok.(*ImageBlock); ok {
+				got = append(got, ib.Data)
+			}
+			if e, ok := tok.(*Extension); ok && e.Label == eComment {
+				t.Error("comment was not stripped")
+			}
+		}
+		for _, tok := range tokens(t, b) {
+			if ib, ok := tok.(*ImageBlock); ok {
+				want = append(want, ib.Data)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d frames, want %d", len(got), len(want))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("frame %d: image data changed", i)
+			}
+		}
+	}
+}
+
+func TestRewriteAddsGraphicControl(t *testing.T) {
+	// testGIF without its graphic control extension.
+	b := append(append([]byte(nil), testGIF[:19]...), testGIF[27:]...)
+	var buf bytes.Buffer
+	err := Rewrite(&buf, bytes.NewReader(b), &RewriteOptions{
+		Delay: func(frame, delay int) int { return 42 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Delay[0] != 42 {
+		t.Errorf("got delay %d, want 42", g.Delay[0])
+	}
+}
+
+func TestRewritePlainTextKeepsGraphicControl(t *testing.T) {
+	// testGIF with a plain text extension between its graphic control
+	// extension and its image, which the extension still applies to.
+	text := []byte{0x21, 0x01, 12, 0, 0, 0, 0, 1, 0, 1, 0, 1, 1, 0, 0, 1, 'x', 0x00}
+	b := append(append(append([]byte(nil), testGIF[:27]...), text...), testGIF[27:]...)
+	var buf bytes.Buffer
+	calls := 0
+	err := Rewrite(&buf, bytes.NewReader(b), &RewriteOptions{
+		Delay: func(frame, delay int) int {
+			calls++
+			return 42
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("Delay called %d times, want 1", calls)
+	}
+	n := 0
+	for _, tok := range tokens(t, buf.Bytes()) {
+		if _, ok := tok.(*GraphicControl); ok {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d graphic control extensions, want 1", n)
+	}
+	g, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Delay[0] != 42 {
+		t.Errorf("got delay %d, want 42", g.Delay[0])
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bufio"
+	"io"
+)
+
+// A StreamReader decodes GIF images that follow one another on a single
+// io.Reader, such as a connection carrying several of them back to back.
+type StreamReader struct {
+	r   *bufio.Reader
+	o   DecodeOptions
+	err error
+	// offset is the number of bytes of the input consumed by the images
+	// decoded so far.
+	offset int64
+}
+
+// NewStreamReader returns a StreamReader reading from r and decoding with
+// the options o, which may be nil.
+func NewStreamReader(r io.Reader, o *DecodeOptions) *StreamReader {
+	s := &StreamReader{}
+	if br, ok := r.(*bufio.Reader); ok {
+		s.r = br
+	} else {
+		s.r = bufio.NewReader(r)
+	}
+	if o != nil {
+		s.o = *o
+	}
+	return s
+}
+
+// Next decodes the next image, reading up to and including its trailer.
+// It returns io.EOF once the input ends where an image would begin. After
+// any other error, the position in the input is lost and Next returns the
+// same error again. The offsets in errors and warnings are from the start
+// of the input.
+func (s *StreamReader) Next() (*GIF, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if _, err := s.r.Peek(1); err != nil {
+		s.err = err
+		return nil, err
+	}
+	d := newDecoder(&s.o)
+	if err := d.decode(s.r, false); err != nil {
+		s.err = s.fixOffset(err)
+		return nil, s.err
+	}
+	for i, w := range d.warnings {
+		d.warnings[i] = s.fixOffset(w)
+	}
+	if !d.trailer {
+		// Lenient decoding kept the frames before an error, after which
+		// the next image cannot be found.
+		s.err = d.warnings[len(d.warnings)-1]
+	}
+	s.offset += d.r.n
+	return d.result(), nil
+}
+
+// fixOffset makes the offset of err, if it is a *DecodeError, relative to
+// the start of the input rather than of the current image.
+func (s *StreamReader) fixOffset(err error) error {
+	if e, ok := err.(*DecodeError); ok {
+		e.Offset += s.offset
+	}
+	return err
+}
+
+// Offset returns the number of bytes of the input consumed by the images
+// decoded so far, which is the offset of the next one.
+func (s *StreamReader) Offset() int64 {
+	return s.offset
+}
@@ -0,0 +1,75 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStreamReader(t *testing.T) {
+	files := []string{
+		"testdata/video-001.gif",
+		"testdata/blob.gif",
+		"testdata/video-005.gray.gif",
+	}
+	var stream []byte
+	var offsets []int64
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, int64(len(stream)))
+		stream = append(stream, b...)
+	}
+	s := NewStreamReader(bytes.NewReader(stream), nil)
+	for i, f := range files {
+		if s.Offset() != offsets[i] {
+			t.Errorf("%s: offset: got %d, want %d", f, s.Offset(), offsets[i])
+		}
+		g, err := s.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		want, err := readGIF(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Image) != len(want.Image) {
+			t.Errorf("%s: got %d frames, want %d", f, len(g.Image), len(want.Image))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Next(); err != io.EOF {
+			t.Errorf("at end: got %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestStreamReaderError(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/video-001.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := append(append([]byte(nil), b...), "GIF89a"...)
+	s := NewStreamReader(bytes.NewReader(stream), nil)
+	if _, err := s.Next(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Next()
+	e, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("got %v, want a *DecodeError", err)
+	}
+	if e.Offset != int64(len(stream)) {
+		t.Errorf("offset: got %d, want %d", e.Offset, len(stream))
+	}
+	if _, err2 := s.Next(); err2 != err {
+		t.Errorf("after error: got %v, want %v", err2, err)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"io"
+	"time"
+)
+
+// Summary describes the frames of a GIF image without their pixel data.
+type Summary struct {
+	// Width and Height are the dimensions of the logical screen.
+	Width, Height int
+	// LoopCount is the loop count, as in gif.GIF.
+	LoopCount int
+	// Bounds holds the successive frame rectangles.
+	Bounds []image.Rectangle
+	// Delay holds the successive delay times, one per frame, in 100ths of
+	// a second.
+	Delay []int
+	// Duration is the total animation time, the sum of the delays.
+	Duration time.Duration
+	// Animated reports whether the image has more than one frame.
+	Animated bool
+}
+
+// DecodeSummary reads a GIF image from r and returns a summary of its
+// frames. The image data is skipped rather than decompressed, which makes
+// it much faster than DecodeAll.
+func DecodeSummary(r io.Reader) (*Summary, error) {
+	d := decoder{summaryOnly: true}
+	if err := d.decode(r, false); err != nil {
+		return nil, err
+	}
+	return &Summary{
+		Width:     d.width,
+		Height:    d.height,
+		LoopCount: d.loopCount,
+		Bounds:    d.bounds,
+		Delay:     d.delay,
+		Duration:  delayDuration(d.totalDelay),
+		Animated:  len(d.bounds) > 1,
+	}, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeSummary(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/*.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: DecodeAll: %v", filename, err)
+			continue
+		}
+		s, err := DecodeSummary(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: DecodeSummary: %v", filename, err)
+			continue
+		}
+		if len(s.Bounds) != len(g.Image) {
+			t.Errorf("%s: got %d frames, want %d", filename, len(s.Bounds), len(g.Image))
+			continue
+		}
+		total := 0
+		for i, m := range g.Image {
+			if s.Bounds[i] != m.Bounds() {
+				t.Errorf("%s: frame %d: got bounds %v, want %v", filename, i, s.Bounds[i], m.Bounds())
+			}
+			if s.Delay[i] != g.Delay[i] {
+				t.Errorf("%s: frame %d: got delay %d, want %d", filename, i, s.Delay[i], g.Delay[i])
+			}
+			total += g.Delay[i]
+		}
+		if s.Duration != delayDuration(total) {
+			t.Errorf("%s: got duration %v, want %v", filename, s.Duration, delayDuration(total))
+		}
+		if s.LoopCount != g.LoopCount {
+			t.Errorf("%s: got loop count %d, want %d", filename, s.LoopCount, g.LoopCount)
+		}
+		if s.Animated != (len(g.Image) > 1) {
+			t.Errorf("%s: got animated %t with %d frames", filename, s.Animated, len(g.Image))
+		}
+	}
+}
+
+func BenchmarkDecodeSummary(b *testing.B) {
+	b.StopTimer()
+	data, err := ioutil.ReadFile("testdata/scape.gif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeSummary(bytes.NewReader(data))
+	}
+}
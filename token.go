@@ -0,0 +1,400 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// A Token is one of the blocks of a GIF file: *Header, *Extension,
+// *GraphicControl, *ImageBlock or *Trailer.
+type Token interface{}
+
+// Header is the GIF header and logical screen descriptor, followed by the
+// global color table if there is one.
+type Header struct {
+	Version         string // "GIF87a" or "GIF89a".
+	Width, Height   int
+	Fields          byte // Packed fields of the logical screen descriptor.
+	BackgroundIndex byte
+	AspectRatio     byte
+	// ColorTable holds the global color table as RGB triples, or nil.
+	ColorTable []byte
+}
+
+// Extension is an extension block other than a graphic control extension.
+type Extension struct {
+	Label byte
+	// Blocks holds the data sub-blocks, without their length bytes or the
+	// block terminator.
+	Blocks [][]byte
+}
+
+// GraphicControl is a graphic control extension.
+type GraphicControl struct {
+	Flags            byte // Packed fields: disposal method, user input and transparent color flags.
+	Delay            int  // Delay time, in 100ths of a second.
+	TransparentIndex byte
+}
+
+// ImageBlock is an image descriptor followed by its local color table and
+// its compressed image data.
+type ImageBlock struct {
+	Left, Top, Width, Height int
+	Fields                   byte // Packed fields of the image descriptor.
+	// ColorTable holds the local color table as RGB triples, or nil.
+	ColorTable []byte
+	LitWidth   byte // LZW minimum code size.
+	// Data holds the image data exactly as stored: LZW-compressed data
+	// sub-blocks with their length bytes, ending with the block terminator.
+	Data []byte
+}
+
+// Trailer marks the end of a GIF file.
+type Trailer struct{}
+
+// Disposal returns the disposal method, one of the gif.Disposal constants
+// or 0 if none is specified.
+func (g *GraphicControl) Disposal() byte {
+	return g.Flags >> 2 & 0x07
+}
+
+// HasTransparentIndex reports whether TransparentIndex is in use.
+func (g *GraphicControl) HasTransparentIndex() bool {
+	return g.Flags&gcTransparentColorSet != 0
+}
+
+// Bounds returns the rectangle the image occupies on the logical screen.
+func (b *ImageBlock) Bounds() image.Rectangle {
+	return image.Rect(b.Left, b.Top, b.Left+b.Width, b.Top+b.Height)
+}
+
+// Compressed returns the LZW-compressed image data with the sub-block
+// structure removed.
+func (b *ImageBlock) Compressed() []byte {
+	var c []byte
+	for d := b.Data; len(d) > 0 && d[0] != 0; d = d[1+int(d[0]):] {
+		if 1+int(d[0]) > len(d) {
+			break
+		}
+		c = append(c, d[1:1+int(d[0])]...)
+	}
+	return c
+}
+
+// SetCompressed sets the image data to the LZW-compressed data c, split
+// into sub-blocks.
+func (b *ImageBlock) SetCompressed(c []byte) {
+	b.Data = b.Data[:0]
+	for len(c) > 0 {
+		n := min(len(c), 255)
+		b.Data = append(b.Data, uint8(n))
+		b.Data = append(b.Data, c[:n]...)
+		c = c[n:]
+	}
+	b.Data = append(b.Data, 0x00)
+}
+
+// colorTableSize returns the size in bytes of the color table described by
+// the packed fields of a logical screen or image descriptor.
+func colorTableSize(fields byte) int {
+	if fields&fColorMapFollows == 0 {
+		return 0
+	}
+	return 3 << (fields&ifPixelSizeMask + 1)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// A Tokenizer reads a GIF file block by block without decompressing the
+// image data.
+type Tokenizer struct {
+	r      *countingReader
+	err    error
+	header bool // Whether the header has been read.
+	tmp    [256]byte
+
+	// skipData is set when only the structure of the file is wanted; the
+	// image data is then skipped and ImageBlock.Data left nil.
+	skipData bool
+}
+
+// NewTokenizer returns a Tokenizer reading from r.
+func NewTokenizer(r io.Reader) *Tokenizer {
+	t := &Tokenizer{}
+	if rr, ok := r.(reader); ok {
+		t.r = &countingReader{r: rr}
+	} else {
+		t.r = &countingReader{r: bufio.NewReader(r)}
+	}
+	return t
+}
+
+// Offset returns the number of bytes of the input consumed so far, which
+// is the offset of the block that the next call to Next returns.
+func (t *Tokenizer) Offset() int64 {
+	return t.r.n
+}
+
+// Next returns the next block of the file. The first is always a *Header
+// and the last a *Trailer, after which Next returns io.EOF.
+func (t *Tokenizer) Next() (Token, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	var tok Token
+	if !t.header {
+		tok, t.err = t.readHeader()
+		t.header = true
+		return tok, t.err
+	}
+	c, err := t.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		t.err = err
+		return nil, t.err
+	}
+	switch c {
+	case sExtension:
+		tok, t.err = t.readExtension()
+	case sImageDescriptor:
+		tok, t.err = t.readImageBlock()
+	case sTrailer:
+		tok, t.err = &Trailer{}, io.EOF
+		return tok, nil
+	default:
+		t.err = fmt.Errorf("gif: unknown block type: 0x%.2x", c)
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	return tok, nil
+}
+
+func (t *Tokenizer) readHeader() (*Header, error) {
+	if _, err := io.ReadFull(t.r, t.tmp[:13]); err != nil {
+		return nil, err
+	}
+	h := &Header{
+		Version:         string(t.tmp[0:6]),
+		Width:           int(t.tmp[6]) + int(t.tmp[7])<<8,
+		Height:          int(t.tmp[8]) + int(t.tmp[9])<<8,
+		Fields:          t.tmp[10],
+		BackgroundIndex: t.tmp[11],
+		AspectRatio:     t.tmp[12],
+	}
+	if h.Version != "GIF87a" && h.Version != "GIF89a" {
+		return nil, fmt.Errorf("gif: can't recognize format %s", h.Version)
+	}
+	var err error
+	h.ColorTable, err = t.readColorTable(h.Fields)
+	return h, err
+}
+
+func (t *Tokenizer) readColorTable(fields byte) ([]byte, error) {
+	n := colorTableSize(fields)
+	if n == 0 {
+		return nil, nil
+	}
+	ct := make([]byte, n)
+	if _, err := io.ReadFull(t.r, ct); err != nil {
+		return nil, fmt.Errorf("gif: short read on color map: %s", err)
+	}
+	return ct, nil
+}
+
+func (t *Tokenizer) readExtension() (Token, error) {
+	label, err := t.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e := &Extension{Label: label}
+	for {
+		n, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(t.r, b); err != nil {
+			return nil, err
+		}
+		e.Blocks = append(e.Blocks, b)
+	}
+	if label == eGraphicControl && len(e.Blocks) == 1 && len(e.Blocks[0]) == gcBlockSize {
+		b := e.Blocks[0]
+		return &GraphicControl{
+			Flags:            b[0],
+			Delay:            int(b[1]) | int(b[2])<<8,
+			TransparentIndex: b[3],
+		}, nil
+	}
+	return e, nil
+}
+
+func (t *Tokenizer) readImageBlock() (*ImageBlock, error) {
+	if _, err := io.ReadFull(t.r, t.tmp[:9]); err != nil {
+		return nil, fmt.Errorf("gif: can't read image descriptor: %s", err)
+	}
+	b := &ImageBlock{
+		Left:   int(t.tmp[0]) + int(t.tmp[1])<<8,
+		Top:    int(t.tmp[2]) + int(t.tmp[3])<<8,
+		Width:  int(t.tmp[4]) + int(t.tmp[5])<<8,
+		Height: int(t.tmp[6]) + int(t.tmp[7])<<8,
+		Fields: t.tmp[8],
+	}
+	var err error
+	if b.ColorTable, err = t.readColorTable(b.Fields); err != nil {
+		return nil, err
+	}
+	if b.LitWidth, err = t.r.ReadByte(); err != nil {
+		return nil, err
+	}
+	for {
+		n, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if t.skipData {
+			if n == 0 {
+				return b, nil
+			}
+			if _, err := io.ReadFull(t.r, t.tmp[:n]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		b.Data = append(b.Data, n)
+		if n == 0 {
+			return b, nil
+		}
+		b.Data = append(b.Data, make([]byte, n)...)
+		if _, err := io.ReadFull(t.r, b.Data[len(b.Data)-int(n):]); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// A TokenWriter writes a GIF file block by block.
+type TokenWriter struct {
+	e *encoder
+}
+
+// NewTokenWriter returns a TokenWriter writing to w. Flush must be called
+// after the last token has been written.
+func NewTokenWriter(w io.Writer) *TokenWriter {
+	return &TokenWriter{e: newEncoder(w)}
+}
+
+// WriteToken writes the block t.
+func (w *TokenWriter) WriteToken(t Token) error {
+	e := w.e
+	if e.err != nil {
+		return e.err
+	}
+	switch t := t.(type) {
+	case *Header:
+		if len(t.Version) != 6 || len(t.ColorTable) != colorTableSize(t.Fields) {
+			e.err = errors.New("gif: invalid header")
+			return e.err
+		}
+		e.write([]byte(t.Version))
+		writeUint16(e.buf[0:2], uint16(t.Width))
+		writeUint16(e.buf[2:4], uint16(t.Height))
+		e.buf[4] = t.Fields
+		e.buf[5] = t.BackgroundIndex
+		e.buf[6] = t.AspectRatio
+		e.write(e.buf[:7])
+		e.write(t.ColorTable)
+
+	case *Extension:
+		// Check every sub-block first, so that nothing of a bad extension
+		// is written.
+		for _, b := range t.Blocks {
+			if len(b) == 0 || len(b) > 255 {
+				e.err = errors.New("gif: invalid extension sub-block size")
+				return e.err
+			}
+		}
+		e.buf[0] = sExtension
+		e.buf[1] = t.Label
+		e.write(e.buf[:2])
+		for _, b := range t.Blocks {
+			e.writeByte(uint8(len(b)))
+			e.write(b)
+		}
+		e.writeByte(0x00) // Block Terminator.
+
+	case *GraphicControl:
+		e.buf[0] = sExtension
+		e.buf[1] = gcLabel
+		e.buf[2] = gcBlockSize
+		e.buf[3] = t.Flags
+		writeUint16(e.buf[4:6], uint16(t.Delay))
+		e.buf[6] = t.TransparentIndex
+		e.buf[7] = 0x00 // Block Terminator.
+		e.write(e.buf[:8])
+
+	case *ImageBlock:
+		if len(t.ColorTable) != colorTableSize(t.Fields) {
+			e.err = errors.New("gif: invalid image block color table")
+			return e.err
+		}
+		if len(t.Data) == 0 || t.Data[len(t.Data)-1] != 0x00 {
+			e.err = errors.New("gif: image data must end with a block terminator")
+			return e.err
+		}
+		e.buf[0] = sImageDescriptor
+		writeUint16(e.buf[1:3], uint16(t.Left))
+		writeUint16(e.buf[3:5], uint16(t.Top))
+		writeUint16(e.buf[5:7], uint16(t.Width))
+		writeUint16(e.buf[7:9], uint16(t.Height))
+		e.buf[9] = t.Fields
+		e.write(e.buf[:10])
+		e.write(t.ColorTable)
+		e.writeByte(t.LitWidth)
+		e.write(t.Data)
+
+	case *Trailer:
+		e.writeByte(sTrailer)
+
+	default:
+		e.err = fmt.Errorf("gif: unknown token type %T", t)
+		return e.err
+	}
+	return e.err
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (w *TokenWriter) Flush() error {
+	w.e.flush()
+	return w.e.err
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tokens returns all the tokens in the GIF file b.
+func tokens(t *testing.T, b []byte) []Token {
+	var toks []Token
+	tr := NewTokenizer(bytes.NewReader(b))
+	for {
+		tok, err := tr.Next()
+		if err == io.EOF {
+			return toks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		toks = append(toks, tok)
+	}
+}
+
+func TestTokenizer(t *testing.T) {
+	toks := tokens(t, testGIF)
+	want := []Token{
+		&Header{
+			Version:    "GIF89a",
+			Width:      1,
+			Height:     1,
+			Fields:     128,
+			ColorTable: []byte{0, 0, 0, 1, 1, 1},
+		},
+		&GraphicControl{TransparentIndex: 0xff},
+		&ImageBlock{
+			Width:    1,
+			Height:   1,
+			LitWidth: 2,
+			Data:     []byte{0x02, 0x4c, 0x01, 0x00},
+		},
+		&Trailer{},
+	}
+	if !reflect.DeepEqual(toks, want) {
+		t.Fatalf("got %v, want %v", toks, want)
+	}
+	ib := toks[2].(*ImageBlock)
+	if got := ib.Compressed(); !bytes.Equal(got, []byte{0x4c, 0x01}) {
+		t.Errorf("Compressed: got %x", got)
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	filenames, err := filepath.Glob("testdata/*.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w := NewTokenWriter(&buf)
+		for _, tok := range tokens(t, b) {
+			if ib, ok := tok.(*ImageBlock); ok {
+				// Re-splitting the compressed data must not change it.
+				var c ImageBlock
+				c.SetCompressed(ib.Compressed())
+				if !bytes.Equal(c.Compressed(), ib.Compressed()) {
+					t.Errorf("%s: SetCompressed changed the image data", filename)
+				}
+			}
+			if err := w.WriteToken(tok); err != nil {
+				t.Fatalf("%s: %v", filename, err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		// Anything after the trailer is not part of the file.
+		if got := buf.Bytes(); !bytes.Equal(got, b[:len(got)]) {
+			t.Errorf("%s: round trip changed the file", filename)
+		}
+		if _, err := DecodeAll(&buf); err != nil {
+			t.Errorf("%s: %v", filename, err)
+		}
+	}
+}
+
+func TestTokenWriterBadToken(t *testing.T) {
+	// A rejected token writes nothing and fails the writer, so that no
+	// corrupt stream is reported as written.
+	for _, tok := range []Token{
+		&Header{Version: "GIF89"},
+		&Header{Version: "GIF89a", Fields: fColorMapFollows, ColorTable: make([]byte, 3)},
+		&Extension{Label: 0xfe, Blocks: [][]byte{[]byte("ok"), make([]byte, 256)}},
+		&Extension{Label: 0xfe, Blocks: [][]byte{{}}},
+		&ImageBlock{Fields: ifLocalColorTable, Data: []byte{0x00}},
+		&ImageBlock{Data: []byte{0x01, 0x00, 0x01}},
+		&ImageBlock{},
+		nil,
+	} {
+		var buf bytes.Buffer
+		w := NewTokenWriter(&buf)
+		if err := w.WriteToken(tok); err == nil {
+			t.Errorf("%#v: WriteToken: got nil error", tok)
+			continue
+		}
+		if err := w.WriteToken(&Trailer{}); err == nil {
+			t.Errorf("%#v: WriteToken after an error: got nil error", tok)
+		}
+		if err := w.Flush(); err == nil {
+			t.Errorf("%#v: Flush after an error: got nil error", tok)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%#v: wrote %d bytes", tok, buf.Len())
+		}
+	}
+}
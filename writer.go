@@ -6,7 +6,6 @@ package gogif
 
 import (
 	"bufio"
-	"compress/lzw"
 	"errors"
 	"image"
 	"image/color"
@@ -57,6 +56,9 @@ type encoder struct {
 	bitsPerPixel int
 	// buf is a scratch buffer. It must be at least 768 so we can write the color map.
 	buf [1024]byte
+	// lzw tunes the compression of the image data and lzwe compresses it.
+	lzw  LZWOptions
+	lzwe *lzwEncoder
 }
 
 // newEncoder returns a new encoder with the given writer.
@@ -70,37 +72,6 @@ func newEncoder(w io.Writer) *encoder {
 	return &e
 }
 
-// blockWriter writes the block structure of GIF image data, which
-// comprises (n, (n bytes)) blocks, with 1 <= n <= 255. It is the
-// writer given to the LZW encoder, which is thus immune to the
-// blocking.
-type blockWriter struct {
-	w   writer
-	err error
-	tmp [256]byte
-}
-
-func (b *blockWriter) Write(data []byte) (int, error) {
-	if b.err != nil {
-		return 0, b.err
-	}
-	if len(data) == 0 {
-		return 0, nil
-	}
-	total := 0
-	for total < len(data) {
-		n := copy(b.tmp[1:256], data[total:])
-		total += n
-		b.tmp[0] = uint8(n)
-
-		n, b.err = b.w.Write(b.tmp[:n+1])
-		if b.err != nil {
-			return 0, b.err
-		}
-	}
-	return total, b.err
-}
-
 func (e *encoder) flush() {
 	if e.err != nil {
 		return
@@ -247,21 +218,28 @@ func (e *encoder) writeImageBlock(pm *image.Paletted, delay int) {
 	// Local Color Table.
 	e.writeColorTable(pm.Palette, paddedSize)
 
-	litWidth := e.bitsPerPixel
+	// The pixels index the local color table.
+	litWidth := paddedSize + 1
 	if litWidth < 2 {
 		litWidth = 2
 	}
 	e.writeByte(uint8(litWidth)) // LZW Minimum Code Size.
-
-	bw := &blockWriter{w: e.w}
-	lzww := lzw.NewWriter(bw, lzw.LSB, litWidth)
-	_, e.err = lzww.Write(pm.Pix)
 	if e.err != nil {
-		lzww.Close()
 		return
 	}
-	lzww.Close()
-	e.writeByte(0x00) // Block Terminator.
+
+	if e.lzwe == nil {
+		e.lzwe = new(lzwEncoder)
+	}
+	lzwe := e.lzwe
+	lzwe.reset(e.w, litWidth, &e.lzw)
+	dx := b.Dx()
+	for y, i := b.Min.Y, pm.PixOffset(b.Min.X, b.Min.Y); y < b.Max.Y; y, i = y+1, i+pm.Stride {
+		if e.err = lzwe.encode(pm.Pix[i : i+dx]); e.err != nil {
+			return
+		}
+	}
+	e.err = lzwe.close() // Including the Block Terminator.
 }
 
 // A Quantizer interface is used by an encoder to construct an
@@ -273,12 +251,25 @@ type Quantizer interface {
 
 // Options are the encoding parameters.
 type Options struct {
+	// Quantizer chooses the palette of an image that is not paletted. If
+	// it is nil, a MedianCutQuantizer of 256 colors is used, which makes
+	// every pixel opaque; to keep transparency, set a quantizer with an
+	// AlphaThreshold, such as 0x8000.
 	Quantizer Quantizer
+	// LZW tunes the compression of the image data.
+	LZW LZWOptions
 }
 
 // EncodeAll writes the images in g to w in GIF format with the
 // given loop count and delay between frames.
 func EncodeAll(w io.Writer, g *gif.GIF) error {
+	return EncodeAllOptions(w, g, nil)
+}
+
+// EncodeAllOptions is like EncodeAll but with the compression tuned by o,
+// which may be nil. The Quantizer is not used, as the images are already
+// paletted.
+func EncodeAllOptions(w io.Writer, g *gif.GIF, o *Options) error {
 	if len(g.Image) == 0 {
 		return errors.New("gif: must provide at least one image")
 	}
@@ -292,6 +283,9 @@ func EncodeAll(w io.Writer, g *gif.GIF) error {
 
 	e := newEncoder(w)
 	e.g = g
+	if o != nil {
+		e.lzw = o.LZW
+	}
 	e.writeHeader()
 	for i, pm := range g.Image {
 		e.writeImageBlock(pm, g.Delay[i])
@@ -309,18 +303,23 @@ func Encode(w io.Writer, m image.Image, o *Options) error {
 		return errors.New("gif: image is too large to encode")
 	}
 
-	if o == nil || o.Quantizer == nil {
-		o = &Options{Quantizer: &MedianCutQuantizer{NumColor: 256}}
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Quantizer == nil {
+		opts.Quantizer = &MedianCutQuantizer{NumColor: 256}
 	}
+	o = &opts
 
 	pm, ok := m.(*image.Paletted)
 	if !ok {
 		pm = image.NewPaletted(b, nil)
-		o.Quantizer.Quantize(pm, b, m, image.ZP)
+		o.Quantizer.Quantize(pm, b, m, b.Min)
 	}
 
-	return EncodeAll(w, &gif.GIF{
+	return EncodeAllOptions(w, &gif.GIF{
 		Image: []*image.Paletted{pm},
 		Delay: []int{0},
-	})
+	}, o)
 }
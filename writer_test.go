@@ -148,6 +148,76 @@ func TestEncodeAll(t *testing.T) {
 	}
 }
 
+func TestEncodeAllOptions(t *testing.T) {
+	g, err := readGIF("testdata/video-001.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := g.Image[0]
+	// A sub-image has a stride wider than its rows.
+	sub := m.SubImage(image.Rect(10, 20, 90, 100)).(*image.Paletted)
+	for _, o := range []LZWOptions{
+		{},
+		{MaxCodeWidth: 10},
+		{KeepFullTable: true},
+		{Uncompressed: true},
+	} {
+		g0 := &gif.GIF{
+			Image: []*image.Paletted{m, sub},
+			Delay: []int{0, 0},
+		}
+		var buf bytes.Buffer
+		if err := EncodeAllOptions(&buf, g0, &Options{LZW: o}); err != nil {
+			t.Errorf("%+v: %v", o, err)
+			continue
+		}
+		g1, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Errorf("%+v: %v", o, err)
+			continue
+		}
+		for i, m0 := range g0.Image {
+			m1 := g1.Image[i]
+			if m0.Bounds() != m1.Bounds() {
+				t.Errorf("%+v: frame %d: bounds differ: %v and %v", o, i, m0.Bounds(), m1.Bounds())
+				continue
+			}
+			if averageDelta(m0, m1) != 0 {
+				t.Errorf("%+v: frame %d: pixels differ", o, i)
+			}
+		}
+	}
+}
+
+func TestEncodeAllLargerLocalPalette(t *testing.T) {
+	// The first frame sets a 2-color global color table; the second needs
+	// 8-bit codes for its own 256 colors.
+	small := image.NewPaletted(image.Rect(0, 0, 16, 16), color.Palette{color.Black, color.White})
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.Gray{uint8(i)}
+	}
+	large := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+	for i := range large.Pix {
+		large.Pix[i] = uint8(i)
+	}
+	g0 := &gif.GIF{
+		Image: []*image.Paletted{small, large},
+		Delay: []int{0, 0},
+	}
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, g0); err != nil {
+		t.Fatal(err)
+	}
+	g1, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(g1.Image[1].Pix, large.Pix) {
+		t.Error("the pixels of the frame with the larger palette differ")
+	}
+}
+
 func BenchmarkEncode(b *testing.B) {
 	b.StopTimer()
 
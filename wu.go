@@ -0,0 +1,233 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/color"
+)
+
+// WuQuantizer constructs a palette with a maximum of NumColor colors by
+// Xiaolin Wu's method. It repeatedly splits the box of RGB space with the
+// largest variance where that reduces the variance the most, rather than
+// at the median of its longest side as MedianCutQuantizer does. This
+// usually gives a lower error overall, with smooth shades such as skin
+// tones better kept, at a similar speed. Colors are counted at 5 bits per
+// channel, in tables of cumulative moments that give the statistics of
+// any box at once.
+type WuQuantizer struct {
+	// NumColor is as for MedianCutQuantizer.
+	NumColor int
+	// AlphaThreshold is as for MedianCutQuantizer.
+	AlphaThreshold uint16
+	// Dither says how to dither the pixels mapped to the palette.
+	Dither Dither
+}
+
+// Quantize sets dst.Palette as well as dst's pixels in r, from the pixels
+// of src starting at sp.
+func (q *WuQuantizer) Quantize(dst *image.Paletted, r image.Rectangle, src image.Image, sp image.Point) {
+	clip(dst, &r, src, &sp)
+	if r.Empty() {
+		return
+	}
+
+	colors := newColorSet(q.NumColor)
+	m := new(wuMoments)
+	transparent := readColors(r, src, sp, q.AlphaThreshold, func(c color.RGBA64, n int) {
+		colors.add(c)
+		m.add(c, n)
+	})
+	setPalette(dst, colors, q.NumColor, transparent, func(numColor int) color.Palette {
+		m.accumulate()
+		return m.palette(numColor)
+	})
+
+	remap(dst, r, src, sp, q.AlphaThreshold, &q.Dither)
+}
+
+const (
+	wuBits = 5
+	// wuSide is the side of the moment tables, with a zero plane before
+	// each axis to simplify the sums.
+	wuSide = 1<<wuBits + 1
+	wuSize = wuSide * wuSide * wuSide
+)
+
+// wuIndex returns the index of cell (r, g, b) of the moment tables.
+func wuIndex(r, g, b int) int {
+	return (r*wuSide+g)*wuSide + b
+}
+
+// wuMoments holds, for each cell of RGB space, the pixel count and the
+// sums of the channels and of their squares over the pixels in it, at
+// first, and over the pixels in all the cells up to it once accumulated.
+type wuMoments struct {
+	w       [wuSize]int64
+	r, g, b [wuSize]int64
+	sq      [wuSize]float64
+}
+
+// add counts n pixels of color c.
+func (m *wuMoments) add(c color.RGBA64, n int) {
+	const shift = 16 - wuBits
+	i := wuIndex(int(c.R>>shift)+1, int(c.G>>shift)+1, int(c.B>>shift)+1)
+	r, g, b, k := int64(c.R), int64(c.G), int64(c.B), int64(n)
+	m.w[i] += k
+	m.r[i] += r * k
+	m.g[i] += g * k
+	m.b[i] += b * k
+	m.sq[i] += float64(r*r+g*g+b*b) * float64(n)
+}
+
+// accumulate replaces the moments of each cell by their sums over the
+// cells up to it on every axis.
+func (m *wuMoments) accumulate() {
+	for _, stride := range []int{1, wuSide, wuSide * wuSide} {
+		for i := stride; i < wuSize; i++ {
+			if i/stride%wuSide == 0 {
+				continue
+			}
+			m.w[i] += m.w[i-stride]
+			m.r[i] += m.r[i-stride]
+			m.g[i] += m.g[i-stride]
+			m.b[i] += m.b[i-stride]
+			m.sq[i] += m.sq[i-stride]
+		}
+	}
+}
+
+// wuBox is a box of cells of the moment tables, from min, exclusive, to
+// max, inclusive, on each axis.
+type wuBox struct {
+	min, max [3]int
+}
+
+// wuStats are the moments of the pixels in a box.
+type wuStats struct {
+	w, r, g, b int64
+	sq         float64
+}
+
+// stats returns the moments of box, from the accumulated tables.
+func (m *wuMoments) stats(box wuBox) wuStats {
+	var s wuStats
+	for corner := 0; corner < 8; corner++ {
+		// Add the sums up to the corners with an even number of min
+		// coordinates, and subtract the others.
+		var c [3]int
+		sign := int64(1)
+		for axis := range c {
+			if corner>>uint(axis)&1 != 0 {
+				c[axis] = box.min[axis]
+				sign = -sign
+			} else {
+				c[axis] = box.max[axis]
+			}
+		}
+		i := wuIndex(c[0], c[1], c[2])
+		s.w += sign * m.w[i]
+		s.r += sign * m.r[i]
+		s.g += sign * m.g[i]
+		s.b += sign * m.b[i]
+		s.sq += float64(sign) * m.sq[i]
+	}
+	return s
+}
+
+// sub returns the moments of the pixels counted in s but not in t.
+func (s wuStats) sub(t wuStats) wuStats {
+	return wuStats{s.w - t.w, s.r - t.r, s.g - t.g, s.b - t.b, s.sq - t.sq}
+}
+
+// score returns the squared sum of the colors over the count, which is
+// what the variance lacks of the sum of the squares. Splitting a box where
+// the scores of its halves add up to the most minimizes their variance.
+func (s wuStats) score() float64 {
+	r, g, b := float64(s.r), float64(s.g), float64(s.b)
+	return (r*r + g*g + b*b) / float64(s.w)
+}
+
+// variance returns the sum of the squared distances of the pixels in box
+// from their mean, or 0 if the box is a single cell and cannot be split.
+func (m *wuMoments) variance(box wuBox) float64 {
+	if box.max[0]-box.min[0] <= 1 && box.max[1]-box.min[1] <= 1 && box.max[2]-box.min[2] <= 1 {
+		return 0
+	}
+	s := m.stats(box)
+	if s.w == 0 {
+		return 0
+	}
+	return s.sq - s.score()
+}
+
+// cut splits box in two across the axis and at the position that
+// minimizes their total variance, leaving one half in box and returning
+// the other. It reports false if the box cannot be split into two halves
+// both with pixels.
+func (m *wuMoments) cut(box *wuBox) (wuBox, bool) {
+	whole := m.stats(*box)
+	best, bestAxis, bestPos := 0.0, -1, 0
+	for axis := 0; axis < 3; axis++ {
+		for pos := box.min[axis] + 1; pos < box.max[axis]; pos++ {
+			lower := *box
+			lower.max[axis] = pos
+			lo := m.stats(lower)
+			hi := whole.sub(lo)
+			if lo.w == 0 || hi.w == 0 {
+				continue
+			}
+			if score := lo.score() + hi.score(); score > best {
+				best, bestAxis, bestPos = score, axis, pos
+			}
+		}
+	}
+	if bestAxis < 0 {
+		return wuBox{}, false
+	}
+	upper := *box
+	upper.min[bestAxis] = bestPos
+	box.max[bestAxis] = bestPos
+	return upper, true
+}
+
+// palette splits the whole of RGB space into at most numColor boxes, and
+// returns the mean colors of the pixels in them.
+func (m *wuMoments) palette(numColor int) color.Palette {
+	if numColor <= 0 {
+		return nil
+	}
+	boxes := []wuBox{{max: [3]int{wuSide - 1, wuSide - 1, wuSide - 1}}}
+	variance := []float64{m.variance(boxes[0])}
+	for len(boxes) < numColor {
+		// Split the box with the largest variance.
+		next := 0
+		for i, v := range variance {
+			if v > variance[next] {
+				next = i
+			}
+		}
+		if variance[next] <= 0 {
+			break
+		}
+		box, ok := m.cut(&boxes[next])
+		if !ok {
+			variance[next] = 0
+			continue
+		}
+		boxes = append(boxes, box)
+		variance[next] = m.variance(boxes[next])
+		variance = append(variance, m.variance(box))
+	}
+	p := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		s := m.stats(box)
+		if s.w == 0 {
+			continue
+		}
+		p = append(p, color.RGBA64{uint16(s.r / s.w), uint16(s.g / s.w), uint16(s.b / s.w), 0xffff})
+	}
+	return p
+}
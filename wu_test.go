@@ -0,0 +1,50 @@
+// Copyright 2013 Andrew Bonventre. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gogif
+
+import (
+	"image"
+	"image/draw"
+	"testing"
+)
+
+func TestWuQuantizer(t *testing.T) {
+	src := frame1080p().SubImage(image.Rect(400, 200, 1000, 800)).(*image.RGBA)
+	for _, numColor := range []int{1, 2, 16, 256} {
+		dst := image.NewPaletted(src.Bounds(), nil)
+		(&WuQuantizer{NumColor: numColor}).Quantize(dst, src.Bounds(), src, src.Bounds().Min)
+		if n := len(dst.Palette); n == 0 || n > numColor {
+			t.Errorf("NumColor %d: got %d colors", numColor, n)
+		}
+	}
+}
+
+func TestWuQuantizerError(t *testing.T) {
+	for _, filename := range []string{"testdata/teapool.png", "testdata/video-001.png"} {
+		m, err := readImg(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := image.NewRGBA(m.Bounds())
+		draw.Draw(src, src.Bounds(), m, m.Bounds().Min, draw.Src)
+		for _, numColor := range []int{16, 64, 256} {
+			got := image.NewPaletted(src.Bounds(), nil)
+			(&WuQuantizer{NumColor: numColor}).Quantize(got, src.Bounds(), src, src.Bounds().Min)
+			want := image.NewPaletted(src.Bounds(), nil)
+			(&MedianCutQuantizer{NumColor: numColor}).Quantize(want, src.Bounds(), src, src.Bounds().Min)
+			if got, want := quantizeError(got, src), quantizeError(want, src); got >= want {
+				t.Errorf("%s NumColor %d: error %.2f, not less than median cut's %.2f", filename, numColor, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkWuQuantize1080p(b *testing.B) {
+	benchmarkQuantizer(b, &WuQuantizer{NumColor: 256}, frame1080p())
+}
+
+func BenchmarkWuQuantizeNoise1080p(b *testing.B) {
+	benchmarkQuantizer(b, &WuQuantizer{NumColor: 256}, noise1080p())
+}